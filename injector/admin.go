@@ -0,0 +1,172 @@
+package injector
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+
+	authenticationv1 "k8s.io/api/authentication/v1"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog"
+)
+
+// AdminAuth restricts the admin endpoints to requests bearing the static token, or a
+// token of Kubernetes which is authorized to the endpoint by a SubjectAccessReview.
+type AdminAuth struct {
+	token string
+	// client reviews the tokens with the apiserver if not nil
+	client kubernetes.Interface
+	// loopbackReload passes reloads from loopback addresses without a token
+	loopbackReload bool
+}
+
+// NewAdminAuth returns the AdminAuth of the admin flags of c. client is required to
+// review the tokens with Kubernetes.
+func NewAdminAuth(c *Config, client kubernetes.Interface) (*AdminAuth, error) {
+	a := &AdminAuth{loopbackReload: c.AdminLoopbackReload}
+	if c.AdminTokenFile != "" {
+		token, err := ioutil.ReadFile(c.AdminTokenFile)
+		if err != nil {
+			return nil, err
+		}
+		if a.token = strings.TrimSpace(string(token)); a.token == "" {
+			return nil, fmt.Errorf("admin token file %s is empty", c.AdminTokenFile)
+		}
+	}
+	if c.AdminKubernetesAuth {
+		if client == nil {
+			return nil, fmt.Errorf("kubernetes client required to review admin tokens")
+		}
+		a.client = client
+	}
+	return a, nil
+}
+
+// Enabled returns whether the admin endpoints require authorization.
+func (a *AdminAuth) Enabled() bool {
+	return a.token != "" || a.client != nil
+}
+
+// Wrap returns a handler which passes the authorized requests to h. All requests are
+// authorized if neither a static token nor Kubernetes is configured, reloads from
+// loopback addresses if loopbackReload is set.
+func (a *AdminAuth) Wrap(h http.Handler) http.Handler {
+	if !a.Enabled() {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if a.loopbackReload && r.Method == http.MethodPost && r.URL.Path == "/-/reload" && isLoopback(r.RemoteAddr) {
+			h.ServeHTTP(w, r)
+			return
+		}
+		if status, err := a.authorize(r); err != nil {
+			klog.Warningf("refused admin request %s %s from %s: %v", r.Method, r.URL.Path, r.RemoteAddr, err)
+			http.Error(w, err.Error(), status)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// isLoopback returns whether the host of addr is a loopback address. Requests from it
+// don't necessarily come from the containers of the pod: a sidecar proxy, e.g. of a
+// service mesh, forwards requests of any client from a loopback address.
+func isLoopback(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+func (a *AdminAuth) authorize(r *http.Request) (int, error) {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return http.StatusUnauthorized, fmt.Errorf("bearer token required")
+	}
+	token := strings.TrimSpace(strings.TrimPrefix(auth, "Bearer "))
+	if a.token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(a.token)) == 1 {
+		return 0, nil
+	}
+	if a.client == nil {
+		return http.StatusUnauthorized, fmt.Errorf("invalid bearer token")
+	}
+	return a.review(r.Context(), token, r.Method, r.URL.Path)
+}
+
+// review authenticates token by a TokenReview, and authorizes its user to the
+// non-resource url path with the verb of method by a SubjectAccessReview.
+func (a *AdminAuth) review(ctx context.Context, token, method, path string) (int, error) {
+	tr, err := a.client.AuthenticationV1().TokenReviews().Create(ctx, &authenticationv1.TokenReview{
+		Spec: authenticationv1.TokenReviewSpec{Token: token},
+	}, metav1.CreateOptions{})
+	if err != nil {
+		return http.StatusInternalServerError, fmt.Errorf("failed to review token: %v", err)
+	}
+	if !tr.Status.Authenticated {
+		return http.StatusUnauthorized, fmt.Errorf("invalid bearer token")
+	}
+	user := tr.Status.User
+	extra := make(map[string]authorizationv1.ExtraValue, len(user.Extra))
+	for k, v := range user.Extra {
+		extra[k] = authorizationv1.ExtraValue(v)
+	}
+	sar, err := a.client.AuthorizationV1().SubjectAccessReviews().Create(ctx, &authorizationv1.SubjectAccessReview{
+		Spec: authorizationv1.SubjectAccessReviewSpec{
+			NonResourceAttributes: &authorizationv1.NonResourceAttributes{Path: path, Verb: strings.ToLower(method)},
+			User:                  user.Username,
+			Groups:                user.Groups,
+			UID:                   user.UID,
+			Extra:                 extra,
+		},
+	}, metav1.CreateOptions{})
+	if err != nil {
+		return http.StatusInternalServerError, fmt.Errorf("failed to review access: %v", err)
+	}
+	if !sar.Status.Allowed {
+		return http.StatusForbidden, fmt.Errorf("%s is not allowed to %s %s", user.Username, method, path)
+	}
+	return 0, nil
+}
+
+// AdminTLSConfig returns the tls config of the admin server, or nil if it serves plain
+// http. Clients have to present a certificate signed by the client CA if one is given.
+func (c *Config) AdminTLSConfig() (*tls.Config, error) {
+	if c.AdminCertFile == "" && c.AdminKeyFile == "" {
+		if c.AdminClientCAFile != "" {
+			return nil, fmt.Errorf("admin client CA requires admin tls cert and key")
+		}
+		return nil, nil
+	}
+	tlsConfig, err := c.serverTLSConfig()
+	if err != nil {
+		return nil, err
+	}
+	cert, err := tls.LoadX509KeyPair(c.AdminCertFile, c.AdminKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig.Certificates = []tls.Certificate{cert}
+	if c.AdminClientCAFile != "" {
+		ca, err := ioutil.ReadFile(c.AdminClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("no certificates found in %s", c.AdminClientCAFile)
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return tlsConfig, nil
+}
@@ -0,0 +1,241 @@
+package injector
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+var okHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+func adminRequest(method, path, token string) *http.Request {
+	r := httptest.NewRequest(method, path, nil)
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	return r
+}
+
+func TestAdminAuthToken(t *testing.T) {
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := ioutil.WriteFile(tokenFile, []byte("secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	auth, err := NewAdminAuth(&Config{AdminTokenFile: tokenFile}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, auth.Enabled())
+	handler := auth.Wrap(okHandler)
+	for token, status := range map[string]int{
+		"":       http.StatusUnauthorized,
+		"wrong":  http.StatusUnauthorized,
+		"secret": http.StatusOK,
+	} {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, adminRequest(http.MethodPost, "/-/reload", token))
+		assert.Equal(t, status, w.Code, token)
+	}
+
+	w := httptest.NewRecorder()
+	noAuth, err := NewAdminAuth(&Config{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.False(t, noAuth.Enabled())
+	noAuth.Wrap(okHandler).ServeHTTP(w, adminRequest(http.MethodPost, "/-/reload", ""))
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	_, err = NewAdminAuth(&Config{AdminKubernetesAuth: true}, nil)
+	assert.Error(t, err)
+}
+
+func TestAdminAuthLoopbackReload(t *testing.T) {
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := ioutil.WriteFile(tokenFile, []byte("secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name           string
+		loopbackReload bool
+		method         string
+		path           string
+		remoteAddr     string
+		expectedStatus int
+	}{
+		{"reload from ipv4 loopback", true, http.MethodPost, "/-/reload", "127.0.0.1:41234", http.StatusOK},
+		{"reload from ipv6 loopback", true, http.MethodPost, "/-/reload", "[::1]:41234", http.StatusOK},
+		{"reload from pod network", true, http.MethodPost, "/-/reload", "10.0.0.1:41234", http.StatusUnauthorized},
+		{"config from loopback", true, http.MethodGet, "/-/config", "127.0.0.1:41234", http.StatusUnauthorized},
+		{"rollback from loopback", true, http.MethodPost, "/-/rollback", "127.0.0.1:41234", http.StatusUnauthorized},
+		{"reload from loopback disabled", false, http.MethodPost, "/-/reload", "127.0.0.1:41234", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			auth, err := NewAdminAuth(&Config{AdminTokenFile: tokenFile, AdminLoopbackReload: tt.loopbackReload}, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			r := adminRequest(tt.method, tt.path, "")
+			r.RemoteAddr = tt.remoteAddr
+			w := httptest.NewRecorder()
+			auth.Wrap(okHandler).ServeHTTP(w, r)
+			assert.Equal(t, tt.expectedStatus, w.Code)
+		})
+	}
+}
+
+func TestAdminAuthKubernetes(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	client.PrependReactor("create", "tokenreviews", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		tr := action.(k8stesting.CreateAction).GetObject().(*authenticationv1.TokenReview)
+		switch tr.Spec.Token {
+		case "operator-token":
+			tr.Status = authenticationv1.TokenReviewStatus{Authenticated: true, User: authenticationv1.UserInfo{Username: "operator"}}
+		case "viewer-token":
+			tr.Status = authenticationv1.TokenReviewStatus{Authenticated: true, User: authenticationv1.UserInfo{Username: "viewer"}}
+		}
+		return true, tr, nil
+	})
+	client.PrependReactor("create", "subjectaccessreviews", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		sar := action.(k8stesting.CreateAction).GetObject().(*authorizationv1.SubjectAccessReview)
+		attrs := sar.Spec.NonResourceAttributes
+		sar.Status.Allowed = sar.Spec.User == "operator" || (attrs.Verb == "get" && attrs.Path == "/-/config")
+		return true, sar, nil
+	})
+	auth, err := NewAdminAuth(&Config{AdminKubernetesAuth: true}, client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := auth.Wrap(okHandler)
+
+	tests := []struct {
+		method, path, token string
+		status              int
+	}{
+		{http.MethodPost, "/-/reload", "", http.StatusUnauthorized},
+		{http.MethodPost, "/-/reload", "unknown-token", http.StatusUnauthorized},
+		{http.MethodPost, "/-/reload", "operator-token", http.StatusOK},
+		{http.MethodPost, "/-/reload", "viewer-token", http.StatusForbidden},
+		{http.MethodGet, "/-/config", "viewer-token", http.StatusOK},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, adminRequest(tt.method, tt.path, tt.token))
+		assert.Equal(t, tt.status, w.Code, "%s %s with %q", tt.method, tt.path, tt.token)
+	}
+}
+
+// writeCert writes a certificate signed by parent, or a self-signed CA if parent is
+// nil, with its key to dir, and returns it.
+func writeCert(t *testing.T, dir, name string, parent *tls.Certificate) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	signer, signerKey := template, interface{}(key)
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature
+	} else {
+		signer, signerKey = parent.Leaf, parent.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+	if err = ioutil.WriteFile(filepath.Join(dir, name+".crt"), certPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(filepath.Join(dir, name+".key"), keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cert.Leaf, err = x509.ParseCertificate(der); err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func TestAdminTLSConfig(t *testing.T) {
+	dir := t.TempDir()
+	ca := writeCert(t, dir, "ca", nil)
+	writeCert(t, dir, "server", &ca)
+	client := writeCert(t, dir, "client", &ca)
+	otherCA := writeCert(t, dir, "other-ca", nil)
+	otherClient := writeCert(t, dir, "other-client", &otherCA)
+
+	c := &Config{}
+	tlsConfig, err := c.AdminTLSConfig()
+	assert.NoError(t, err)
+	assert.Nil(t, tlsConfig)
+	c.AdminClientCAFile = filepath.Join(dir, "ca.crt")
+	_, err = c.AdminTLSConfig()
+	assert.Error(t, err)
+
+	c.AdminCertFile, c.AdminKeyFile = filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key")
+	tlsConfig, err = c.AdminTLSConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewUnstartedServer(okHandler)
+	server.TLS = tlsConfig
+	server.StartTLS()
+	defer server.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Leaf)
+	for name, certs := range map[string][]tls.Certificate{
+		"client":         {client},
+		"other client":   {otherClient},
+		"no client cert": nil,
+	} {
+		httpClient := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots, Certificates: certs}}}
+		resp, err := httpClient.Get(server.URL)
+		if name == "client" {
+			if assert.NoError(t, err, name) {
+				assert.Equal(t, http.StatusOK, resp.StatusCode)
+				resp.Body.Close()
+			}
+		} else {
+			assert.Error(t, err, name)
+		}
+	}
+}
@@ -0,0 +1,272 @@
+package injector
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"math"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/api/admission/v1beta1"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/klog"
+)
+
+const (
+	AuditDecisionInjected  = "injected"
+	AuditDecisionSkipped   = "skipped"
+	AuditDecisionUnchanged = "unchanged"
+	AuditDecisionAllowed   = "allowed"
+	AuditDecisionDenied    = "denied"
+
+	auditRedacted          = "REDACTED"
+	auditAnnotationsPrefix = "logging.kubesphere.io/"
+)
+
+// AuditRecord records the decision of the injector on one admission.
+type AuditRecord struct {
+	Time         time.Time         `json:"time"`
+	UID          types.UID         `json:"uid"`
+	Operation    v1beta1.Operation `json:"operation"`
+	Namespace    string            `json:"namespace"`
+	Name         string            `json:"name,omitempty"`
+	GenerateName string            `json:"generateName,omitempty"`
+	// Owner is the controller of the pod as kind/name
+	Owner string                    `json:"owner,omitempty"`
+	User  authenticationv1.UserInfo `json:"user"`
+	// Decision is one of injected, skipped, unchanged, allowed and denied
+	Decision string   `json:"decision"`
+	Reason   string   `json:"reason,omitempty"`
+	Warnings []string `json:"warnings,omitempty"`
+	// LogPaths are the log paths resolved within the sidecar
+	LogPaths []string `json:"logPaths,omitempty"`
+	Sidecar  string   `json:"sidecar,omitempty"`
+	// Backend is the sink type the sidecar ships logs to, or stdout
+	Backend          string `json:"backend,omitempty"`
+	ConfigGeneration int64  `json:"configGeneration,omitempty"`
+	PatchSize        int    `json:"patchSize"`
+	// Annotations are the logging.kubesphere.io annotations of the admitted pod
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+func newAuditRecord(ar v1beta1.AdmissionReview, now time.Time) *AuditRecord {
+	return &AuditRecord{
+		Time:      now,
+		UID:       ar.Request.UID,
+		Operation: ar.Request.Operation,
+		Namespace: ar.Request.Namespace,
+		Name:      ar.Request.Name,
+		User:      ar.Request.UserInfo,
+	}
+}
+
+func (rec *AuditRecord) setPod(pod *corev1.Pod) {
+	if pod.Namespace != "" {
+		rec.Namespace = pod.Namespace
+	}
+	if pod.Name != "" {
+		rec.Name = pod.Name
+	}
+	rec.GenerateName = pod.GenerateName
+	if owner := metav1.GetControllerOf(pod); owner != nil {
+		rec.Owner = owner.Kind + "/" + owner.Name
+	}
+	for k, v := range pod.Annotations {
+		if !strings.HasPrefix(k, auditAnnotationsPrefix) {
+			continue
+		}
+		if rec.Annotations == nil {
+			rec.Annotations = make(map[string]string)
+		}
+		rec.Annotations[k] = v
+	}
+}
+
+func (rec *AuditRecord) setConfig(iconfig *InjectorConfig) {
+	rec.Sidecar = iconfig.SidecarType
+	rec.ConfigGeneration = iconfig.Generation
+}
+
+// setResponse takes the decision of resp, unless an allowed resp was decided on before.
+func (rec *AuditRecord) setResponse(resp *v1beta1.AdmissionResponse) {
+	rec.PatchSize = len(resp.Patch)
+	if !resp.Allowed {
+		rec.Decision = AuditDecisionDenied
+		if resp.Result != nil {
+			rec.Reason = resp.Result.Message
+		}
+		return
+	}
+	if rec.Decision == "" {
+		rec.Decision = AuditDecisionAllowed
+	}
+}
+
+// AuditLog writes AuditRecords as lines of json to a file or stdout. Denied admissions
+// are always written, others as sampled. The values of sensitive annotations are
+// redacted. A nil AuditLog writes nothing.
+type AuditLog struct {
+	mu sync.Mutex
+	w  io.Writer
+	// sampleRate is the fraction of allowed admissions written
+	sampleRate float64
+	redact     map[string]bool
+}
+
+// NewAuditLog returns the AuditLog of the audit flags of c, or nil if disabled.
+func NewAuditLog(c *Config) (*AuditLog, error) {
+	if c.AuditLogPath == "" {
+		return nil, nil
+	}
+	if c.AuditLogSampleRate < 0 || c.AuditLogSampleRate > 1 || math.IsNaN(c.AuditLogSampleRate) {
+		return nil, fmt.Errorf("audit log sample rate %v not within [0, 1]", c.AuditLogSampleRate)
+	}
+	var w io.Writer = os.Stdout
+	if c.AuditLogPath != "-" {
+		f, err := openRotatingFile(c.AuditLogPath, int64(c.AuditLogMaxSize)<<20, c.AuditLogMaxBackups)
+		if err != nil {
+			return nil, err
+		}
+		w = f
+	}
+	return newAuditLog(w, c.AuditLogSampleRate, splitList(c.AuditLogRedactAnnotations)), nil
+}
+
+func newAuditLog(w io.Writer, sampleRate float64, redactAnnotations []string) *AuditLog {
+	a := &AuditLog{w: w, sampleRate: sampleRate, redact: make(map[string]bool)}
+	for _, k := range redactAnnotations {
+		a.redact[k] = true
+	}
+	return a
+}
+
+// sampled tells whether to write rec. Records are sampled by their uid, so that all
+// records of an admission retried by the apiserver are written or none.
+func (a *AuditLog) sampled(rec *AuditRecord) bool {
+	if rec.Decision == AuditDecisionDenied || a.sampleRate >= 1 {
+		return true
+	}
+	h := fnv.New32a()
+	h.Write([]byte(rec.UID))
+	return float64(h.Sum32()) < a.sampleRate*(1<<32)
+}
+
+// Log writes rec if sampled, with the values of sensitive annotations redacted.
+func (a *AuditLog) Log(rec *AuditRecord) {
+	if a == nil || !a.sampled(rec) {
+		return
+	}
+	out := *rec
+	if len(rec.Annotations) > 0 {
+		out.Annotations = make(map[string]string, len(rec.Annotations))
+		for k, v := range rec.Annotations {
+			if a.redact[k] {
+				v = auditRedacted
+			}
+			out.Annotations[k] = v
+		}
+	}
+	line, err := json.Marshal(&out)
+	if err != nil {
+		klog.Errorf("failed to marshal audit record of %s: %v", rec.UID, err)
+		return
+	}
+	line = append(line, '\n')
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, err := a.w.Write(line); err != nil {
+		klog.Errorf("failed to write audit record of %s: %v", rec.UID, err)
+	}
+}
+
+// Close closes the file of the AuditLog.
+func (a *AuditLog) Close() error {
+	if a == nil {
+		return nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if f, ok := a.w.(*rotatingFile); ok {
+		return f.Close()
+	}
+	return nil
+}
+
+// rotatingFile is a file which is rotated to path.1, path.2 and so on before it grows
+// beyond maxSize, keeping maxBackups rotated files. It never rotates if maxSize is 0.
+// Writes have to be serialized by the caller.
+type rotatingFile struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+
+	file *os.File
+	size int64
+}
+
+func openRotatingFile(path string, maxSize int64, maxBackups int) (*rotatingFile, error) {
+	f := &rotatingFile{path: path, maxSize: maxSize, maxBackups: maxBackups}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *rotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file, f.size = file, info.Size()
+	return nil
+}
+
+func (f *rotatingFile) Write(p []byte) (int, error) {
+	if f.maxSize > 0 && f.size > 0 && f.size+int64(len(p)) > f.maxSize {
+		if err := f.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+// rotate moves the file to the first backup and opens a new one. The file is reopened
+// even if moving it failed, so that records are appended rather than lost.
+func (f *rotatingFile) rotate() error {
+	f.file.Close()
+	if err := f.moveToBackup(); err != nil {
+		klog.Errorf("failed to rotate %s: %v", f.path, err)
+	}
+	return f.open()
+}
+
+func (f *rotatingFile) moveToBackup() error {
+	if f.maxBackups == 0 {
+		return os.Remove(f.path)
+	}
+	for i := f.maxBackups - 1; i > 0; i-- {
+		backup := fmt.Sprintf("%s.%d", f.path, i)
+		if err := os.Rename(backup, fmt.Sprintf("%s.%d", f.path, i+1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return os.Rename(f.path, f.path+".1")
+}
+
+func (f *rotatingFile) Close() error {
+	return f.file.Close()
+}
@@ -0,0 +1,156 @@
+package injector
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/api/admission/v1beta1"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func auditRecords(t *testing.T, buf *bytes.Buffer) []AuditRecord {
+	var records []AuditRecord
+	for s := bufio.NewScanner(buf); s.Scan(); {
+		var rec AuditRecord
+		if err := json.Unmarshal(s.Bytes(), &rec); err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, rec)
+	}
+	return records
+}
+
+func TestAuditMutateLogsidecarPods(t *testing.T) {
+	ic := loadShippedInjectorConfig(t, SidecarTypeVector)
+	ic.Generation = 3
+	inj := newTestInjector(ic)
+	var buf bytes.Buffer
+	inj.Audit = newAuditLog(&buf, 1, []string{logsidecarSinkAnnotationName})
+
+	pod := appPod()
+	pod.Name, pod.GenerateName = "", "app-"
+	pod.OwnerReferences = []metav1.OwnerReference{{Kind: "ReplicaSet", Name: "app-5d4f", Controller: new(bool)}}
+	*pod.OwnerReferences[0].Controller = true
+	pod.Annotations[logsidecarSinkAnnotationName] = `{"type": "loki", "endpoints": ["http://loki:3100"], "auth": {"user": "admin"}}`
+	ar := podAdmissionReview(t, v1beta1.Create, pod, nil)
+	ar.Request.UID = "uid-1"
+	ar.Request.UserInfo = authenticationv1.UserInfo{Username: "system:serviceaccount:kube-system:replicaset-controller"}
+	resp := inj.MutateLogsidecarPods(context.Background(), ar)
+
+	skipped := appPod()
+	skipped.Annotations[logsidecarAnnotationName] = " "
+	inj.MutateLogsidecarPods(context.Background(), podAdmissionReview(t, v1beta1.Create, skipped, nil))
+
+	denied := appPod()
+	denied.Annotations[logsidecarAnnotationName] = "{"
+	inj.MutateLogsidecarPods(context.Background(), podAdmissionReview(t, v1beta1.Create, denied, nil))
+
+	records := auditRecords(t, &buf)
+	if !assert.Len(t, records, 3) {
+		return
+	}
+	rec := records[0]
+	assert.Equal(t, types.UID("uid-1"), rec.UID)
+	assert.Equal(t, v1beta1.Create, rec.Operation)
+	assert.Equal(t, "default", rec.Namespace)
+	assert.Equal(t, "app-", rec.GenerateName)
+	assert.Equal(t, "ReplicaSet/app-5d4f", rec.Owner)
+	assert.Equal(t, ar.Request.UserInfo.Username, rec.User.Username)
+	assert.Equal(t, AuditDecisionInjected, rec.Decision)
+	assert.Equal(t, []string{"/container-app-container/data/*.log"}, rec.LogPaths)
+	assert.Equal(t, SidecarTypeVector, rec.Sidecar)
+	assert.Equal(t, SinkTypeLoki, rec.Backend)
+	assert.Equal(t, int64(3), rec.ConfigGeneration)
+	assert.Equal(t, len(resp.Patch), rec.PatchSize)
+	assert.Equal(t, pod.Annotations[logsidecarAnnotationName], rec.Annotations[logsidecarAnnotationName])
+	assert.Equal(t, auditRedacted, rec.Annotations[logsidecarSinkAnnotationName])
+	assert.NotContains(t, buf.String(), "admin")
+
+	assert.Equal(t, AuditDecisionSkipped, records[1].Decision)
+	assert.Equal(t, "empty config", records[1].Reason)
+
+	assert.Equal(t, AuditDecisionDenied, records[2].Decision)
+	assert.Contains(t, records[2].Reason, "unable to decode annotations")
+	assert.Zero(t, records[2].PatchSize)
+}
+
+func TestAuditLogSampling(t *testing.T) {
+	var buf bytes.Buffer
+	a := newAuditLog(&buf, 0.5, nil)
+	const n = 1000
+	for i := 0; i < n; i++ {
+		a.Log(&AuditRecord{UID: types.UID(fmt.Sprintf("uid-%d", i)), Decision: AuditDecisionAllowed})
+	}
+	sampled := len(auditRecords(t, &buf))
+	assert.InDelta(t, n/2, sampled, n/10)
+
+	// records of one uid are sampled alike
+	for i := 0; i < n; i++ {
+		a.Log(&AuditRecord{UID: types.UID(fmt.Sprintf("uid-%d", i)), Decision: AuditDecisionInjected})
+	}
+	assert.Len(t, auditRecords(t, &buf), sampled)
+
+	a = newAuditLog(&buf, 0, nil)
+	a.Log(&AuditRecord{UID: "allowed", Decision: AuditDecisionAllowed})
+	a.Log(&AuditRecord{UID: "denied", Decision: AuditDecisionDenied})
+	records := auditRecords(t, &buf)
+	if assert.Len(t, records, 1) {
+		assert.Equal(t, types.UID("denied"), records[0].UID)
+	}
+
+	// a nil AuditLog is disabled
+	var disabled *AuditLog
+	disabled.Log(&AuditRecord{Decision: AuditDecisionDenied})
+	assert.NoError(t, disabled.Close())
+}
+
+func TestRotatingFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "audit.log")
+
+	f, err := openRotatingFile(path, 10, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{"one\n", "two\n", "three\n", "four\n", "five\n"} {
+		if _, err := f.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	assert.NoError(t, f.Close())
+
+	for file, content := range map[string]string{path: "four\nfive\n", path + ".1": "three\n", path + ".2": "one\ntwo\n"} {
+		got, err := ioutil.ReadFile(file)
+		if assert.NoError(t, err) {
+			assert.Equal(t, content, string(got), file)
+		}
+	}
+	_, err = os.Stat(path + ".3")
+	assert.True(t, os.IsNotExist(err))
+
+	// an existing file is appended to
+	f, err = openRotatingFile(path, 0, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.Write([]byte(strings.Repeat("x", 20) + "\n"))
+	assert.NoError(t, err)
+	assert.NoError(t, f.Close())
+	got, _ := ioutil.ReadFile(path)
+	assert.True(t, strings.HasPrefix(string(got), "four\nfive\n"))
+}
@@ -0,0 +1,79 @@
+package injector
+
+import (
+	"fmt"
+	"path/filepath"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	logsidecarCheckpointVolumeName = "logsidecar-checkpoint-volume-logging-kubesphere-io"
+	logsidecarDataDir              = "/var/lib/logsidecar"
+
+	checkpointPodNamespaceEnvName = "LOGSIDECAR_POD_NAMESPACE"
+	checkpointPodNameEnvName      = "LOGSIDECAR_POD_NAME"
+)
+
+// CheckpointConfig configures the volume the sidecar keeps its checkpoints on, i.e. the
+// data_dir of vector or the registry of filebeat. It is an emptyDir if neither HostPath
+// nor Ephemeral is set, which keeps the checkpoints across restarts of the sidecar, but
+// not across recreations of the pod.
+type CheckpointConfig struct {
+	// HostPath is a directory on the node, below which a pod keeps its checkpoints in
+	// the directory <namespace>/<name> of the pod, so that a pod recreated on the same
+	// node with the same name, e.g. of a statefulset, resumes from them
+	HostPath string `json:"hostPath,omitempty" yaml:"hostPath,omitempty"`
+	// Ephemeral is the spec of a volume claim created along with each pod and named
+	// after it, to keep the checkpoints off the disk of the node
+	Ephemeral *corev1.PersistentVolumeClaimSpec `json:"ephemeral,omitempty" yaml:"ephemeral,omitempty"`
+}
+
+func validateCheckpoint(checkpoint *CheckpointConfig) error {
+	if checkpoint.HostPath != "" && checkpoint.Ephemeral != nil {
+		return fmt.Errorf("checkpoint requires one of hostPath and ephemeral")
+	}
+	if checkpoint.HostPath != "" && (!filepath.IsAbs(checkpoint.HostPath) || filepath.Clean(checkpoint.HostPath) == "/") {
+		return fmt.Errorf("checkpoint.hostPath %s is not an absolute path below /", checkpoint.HostPath)
+	}
+	if checkpoint.Ephemeral != nil {
+		if _, ok := checkpoint.Ephemeral.Resources.Requests[corev1.ResourceStorage]; !ok {
+			return fmt.Errorf("checkpoint.ephemeral requires resources.requests.storage")
+		}
+	}
+	return nil
+}
+
+// checkpointPart returns the checkpoint volume of checkpoint, and the volume mount and
+// env vars the sidecar needs to keep its checkpoints in the data dir of names.
+func checkpointPart(checkpoint *CheckpointConfig, names NamesConfig) (corev1.Volume, corev1.VolumeMount, []corev1.EnvVar) {
+	volume := corev1.Volume{Name: names.CheckpointVolume}
+	volumeMount := corev1.VolumeMount{Name: names.CheckpointVolume, MountPath: names.DataDir}
+	switch {
+	case checkpoint.HostPath != "":
+		hostPathType := corev1.HostPathDirectoryOrCreate
+		volume.HostPath = &corev1.HostPathVolumeSource{Path: checkpoint.HostPath, Type: &hostPathType}
+		volumeMount.SubPathExpr = fmt.Sprintf("$(%s)/$(%s)", checkpointPodNamespaceEnvName, checkpointPodNameEnvName)
+		return volume, volumeMount, []corev1.EnvVar{
+			fieldRefEnv(checkpointPodNamespaceEnvName, "metadata.namespace"),
+			fieldRefEnv(checkpointPodNameEnvName, "metadata.name"),
+		}
+	case checkpoint.Ephemeral != nil:
+		spec := checkpoint.Ephemeral.DeepCopy()
+		if len(spec.AccessModes) == 0 {
+			spec.AccessModes = []corev1.PersistentVolumeAccessMode{corev1.ReadWriteOnce}
+		}
+		volume.Ephemeral = &corev1.EphemeralVolumeSource{
+			VolumeClaimTemplate: &corev1.PersistentVolumeClaimTemplate{Spec: *spec},
+		}
+	default:
+		volume.EmptyDir = &corev1.EmptyDirVolumeSource{}
+	}
+	return volume, volumeMount, nil
+}
+
+func fieldRefEnv(name, fieldPath string) corev1.EnvVar {
+	return corev1.EnvVar{Name: name, ValueFrom: &corev1.EnvVarSource{
+		FieldRef: &corev1.ObjectFieldSelector{FieldPath: fieldPath},
+	}}
+}
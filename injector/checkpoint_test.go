@@ -0,0 +1,106 @@
+package injector
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/api/admission/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"sigs.k8s.io/yaml"
+)
+
+func TestValidateCheckpoint(t *testing.T) {
+	storage := corev1.ResourceRequirements{Requests: corev1.ResourceList{corev1.ResourceStorage: resource.MustParse("1Gi")}}
+	tests := []struct {
+		name       string
+		checkpoint CheckpointConfig
+		valid      bool
+	}{
+		{"emptyDir", CheckpointConfig{}, true},
+		{"hostPath", CheckpointConfig{HostPath: "/var/lib/logsidecar"}, true},
+		{"relative hostPath", CheckpointConfig{HostPath: "var/lib/logsidecar"}, false},
+		{"root hostPath", CheckpointConfig{HostPath: "/"}, false},
+		{"ephemeral", CheckpointConfig{Ephemeral: &corev1.PersistentVolumeClaimSpec{Resources: storage}}, true},
+		{"ephemeral without storage", CheckpointConfig{Ephemeral: &corev1.PersistentVolumeClaimSpec{}}, false},
+		{"hostPath and ephemeral", CheckpointConfig{HostPath: "/var/lib/logsidecar",
+			Ephemeral: &corev1.PersistentVolumeClaimSpec{Resources: storage}}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateCheckpoint(&tt.checkpoint)
+			assert.Equal(t, tt.valid, err == nil, err)
+		})
+	}
+}
+
+func TestLogsidecarPodCheckpoint(t *testing.T) {
+	storageClass := "standard"
+	storage := corev1.ResourceRequirements{Requests: corev1.ResourceList{corev1.ResourceStorage: resource.MustParse("1Gi")}}
+	hostPathType := corev1.HostPathDirectoryOrCreate
+	tests := []struct {
+		name                string
+		checkpoint          CheckpointConfig
+		expectedVolume      corev1.VolumeSource
+		expectedSubPathExpr string
+		expectedEnv         []corev1.EnvVar
+	}{{
+		name:           "emptyDir",
+		expectedVolume: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}},
+	}, {
+		name:                "hostPath",
+		checkpoint:          CheckpointConfig{HostPath: "/var/lib/logsidecar"},
+		expectedVolume:      corev1.VolumeSource{HostPath: &corev1.HostPathVolumeSource{Path: "/var/lib/logsidecar", Type: &hostPathType}},
+		expectedSubPathExpr: "$(LOGSIDECAR_POD_NAMESPACE)/$(LOGSIDECAR_POD_NAME)",
+		expectedEnv: []corev1.EnvVar{
+			{Name: "LOGSIDECAR_POD_NAMESPACE", ValueFrom: &corev1.EnvVarSource{FieldRef: &corev1.ObjectFieldSelector{FieldPath: "metadata.namespace"}}},
+			{Name: "LOGSIDECAR_POD_NAME", ValueFrom: &corev1.EnvVarSource{FieldRef: &corev1.ObjectFieldSelector{FieldPath: "metadata.name"}}},
+		},
+	}, {
+		name:       "ephemeral",
+		checkpoint: CheckpointConfig{Ephemeral: &corev1.PersistentVolumeClaimSpec{StorageClassName: &storageClass, Resources: storage}},
+		expectedVolume: corev1.VolumeSource{Ephemeral: &corev1.EphemeralVolumeSource{
+			VolumeClaimTemplate: &corev1.PersistentVolumeClaimTemplate{Spec: corev1.PersistentVolumeClaimSpec{
+				AccessModes:      []corev1.PersistentVolumeAccessMode{corev1.ReadWriteOnce},
+				StorageClassName: &storageClass,
+				Resources:        storage,
+			}},
+		}},
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			iconfig := loadShippedInjectorConfig(t, SidecarTypeVector)
+			iconfig.SidecarConfig.Checkpoint = tt.checkpoint
+			iconfig.SidecarConfig.Names.DataDir = "/var/lib/vector"
+			ar := podAdmissionReview(t, v1beta1.Create, appPod(), nil)
+			injected := applyAdmissionPatch(t, ar, newTestInjector(iconfig).MutateLogsidecarPods(context.Background(), ar))
+
+			assert.Contains(t, injected.Spec.Volumes, corev1.Volume{Name: logsidecarCheckpointVolumeName, VolumeSource: tt.expectedVolume})
+			sidecar := injected.Spec.Containers[len(injected.Spec.Containers)-1]
+			assert.Contains(t, sidecar.VolumeMounts, corev1.VolumeMount{Name: logsidecarCheckpointVolumeName,
+				MountPath: "/var/lib/vector", SubPathExpr: tt.expectedSubPathExpr})
+			assert.Equal(t, tt.expectedEnv, sidecar.Env)
+
+			// the data dir of the rendered config is the mounted one
+			configEcho := injected.Spec.InitContainers[0].Args[1]
+			assert.Contains(t, configEcho, `data_dir: \"/var/lib/vector\"`)
+			assert.NotContains(t, configEcho, "/etc/logsidecar\\\"")
+		})
+	}
+}
+
+func TestShippedFilebeatTemplateDataDir(t *testing.T) {
+	iconfig := loadShippedInjectorConfig(t, SidecarTypeFilebeat)
+	configYaml, _, err := renderSidecarConfig(context.Background(), iconfig, appPod(), []string{"/container-app/*.log"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var config map[string]interface{}
+	if err = yaml.Unmarshal([]byte(configYaml), &config); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, logsidecarDataDir, config["path.data"])
+	assert.False(t, strings.Contains(configYaml, logsidecarConfigDir))
+}
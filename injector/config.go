@@ -1,14 +1,24 @@
 package injector
 
 import (
+	"context"
+	"crypto/sha256"
 	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"io/ioutil"
+	"path/filepath"
+	"strings"
 	"sync"
 	"text/template"
+	"time"
 
 	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
 	"sigs.k8s.io/yaml"
 )
 
@@ -21,26 +31,128 @@ const (
 )
 
 type Config struct {
-	CertFile string
-	KeyFile  string
+	ListenAddress string
+	CertFile      string
+	KeyFile       string
+
+	// ClientCAFile and AllowedClientNames restrict the clients of the webhook
+	ClientCAFile       string
+	AllowedClientNames string
+
+	TLSMinVersion       string
+	TLSCipherSuites     string
+	TLSCurvePreferences string
+	HTTP2               bool
+
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+	IdleTimeout  time.Duration
 
 	SidecarType string
 
 	FilebeatConfigFile string
 	SidecarConfigFile  string
 	VectorConfigFile   string
+
+	AdminAddress        string
+	AdminTokenFile      string
+	AdminKubernetesAuth bool
+	// AdminLoopbackReload exempts reloads from loopback addresses from authorization
+	AdminLoopbackReload bool
+	AdminCertFile       string
+	AdminKeyFile        string
+	AdminClientCAFile   string
+
+	// AuditLogPath is the file of the audit log, - for stdout, or empty to disable it
+	AuditLogPath              string
+	AuditLogMaxSize           int
+	AuditLogMaxBackups        int
+	AuditLogSampleRate        float64
+	AuditLogRedactAnnotations string
+
+	// TracingEndpoint is the OTLP/HTTP collector to export spans to, or empty to disable tracing
+	TracingEndpoint    string
+	TracingInsecure    bool
+	TracingSampleRatio float64
+
+	Kubeconfig             string
+	DriftDetection         bool
+	DriftDetectionInterval time.Duration
+	DriftRolloutRestart    bool
+	// LeaderElection runs the drift detection in the replica holding the lease only
+	LeaderElection          bool
+	LeaderElectionNamespace string
+	LeaderElectionLeaseName string
 }
 
 type ContainerConfig struct {
 	Image           string                  `json:"image,omitempty" yaml:"image,omitempty"`
 	ImagePullPolicy v1.PullPolicy           `json:"imagePullPolicy,omitempty" yaml:"imagePullPolicy,omitempty"`
 	Resources       v1.ResourceRequirements `json:"resources" yaml:"resources"`
+	// Env, EnvFrom and VolumeMounts are added to the injected container, e.g. to refer
+	// to secrets the config templates use as ${ENV} placeholders
+	Env          []v1.EnvVar        `json:"env,omitempty" yaml:"env,omitempty"`
+	EnvFrom      []v1.EnvFromSource `json:"envFrom,omitempty" yaml:"envFrom,omitempty"`
+	VolumeMounts []v1.VolumeMount   `json:"volumeMounts,omitempty" yaml:"volumeMounts,omitempty"`
 }
 
 type SidecarConfig struct {
 	InitContainer     ContainerConfig `json:"initContainer" yaml:"initContainer"`
 	FilebeatContainer ContainerConfig `json:"filebeatContainer,omitempty" yaml:"filebeatContainer,omitempty"`
 	VectorContainer   ContainerConfig `json:"vectorContainer,omitempty" yaml:"vectorContainer,omitempty"`
+	// Sink is the default backend the sidecar ships logs to, or stdout if nil
+	Sink *SinkConfig `json:"sink,omitempty" yaml:"sink,omitempty"`
+	// Volumes are added to the pod for the volumeMounts of the injected containers
+	Volumes []v1.Volume `json:"volumes,omitempty" yaml:"volumes,omitempty"`
+	// Names of the injected parts, the defaults if omitted
+	Names NamesConfig `json:"names,omitempty" yaml:"names,omitempty"`
+	// Checkpoint is the volume the sidecar keeps its checkpoints on, an emptyDir if omitted
+	Checkpoint CheckpointConfig `json:"checkpoint,omitempty" yaml:"checkpoint,omitempty"`
+}
+
+// NamesConfig names the containers and volumes injected into pods, and the directories
+// the sidecar finds its config and the log volumes at. Empty fields take the defaults.
+type NamesConfig struct {
+	InitContainer    string `json:"initContainer,omitempty" yaml:"initContainer,omitempty"`
+	Container        string `json:"container,omitempty" yaml:"container,omitempty"`
+	ConfigVolume     string `json:"configVolume,omitempty" yaml:"configVolume,omitempty"`
+	SinkVolume       string `json:"sinkVolume,omitempty" yaml:"sinkVolume,omitempty"`
+	CheckpointVolume string `json:"checkpointVolume,omitempty" yaml:"checkpointVolume,omitempty"`
+	// ConfigDir is the directory the config of the sidecar is written to
+	ConfigDir string `json:"configDir,omitempty" yaml:"configDir,omitempty"`
+	// DataDir is the directory the sidecar keeps its checkpoints in
+	DataDir string `json:"dataDir,omitempty" yaml:"dataDir,omitempty"`
+	// LogMountPrefix followed by the name of an application container is the directory
+	// the sidecar mounts the log volumes of that container below, e.g. /container-app
+	LogMountPrefix string `json:"logMountPrefix,omitempty" yaml:"logMountPrefix,omitempty"`
+}
+
+// withDefaults returns n with the empty fields set to the defaults.
+func (n NamesConfig) withDefaults() NamesConfig {
+	for _, f := range []struct {
+		field    *string
+		fallback string
+	}{
+		{&n.InitContainer, logsidecarInitContainerName},
+		{&n.Container, logsidecarContainerName},
+		{&n.ConfigVolume, logsidecarVolumeName},
+		{&n.SinkVolume, logsidecarSinkVolumeName},
+		{&n.CheckpointVolume, logsidecarCheckpointVolumeName},
+		{&n.ConfigDir, logsidecarConfigDir},
+		{&n.DataDir, logsidecarDataDir},
+		{&n.LogMountPrefix, logsidecarLogMountPrefix},
+	} {
+		if *f.field == "" {
+			*f.field = f.fallback
+		}
+	}
+	return n
+}
+
+// logMountDir returns the directory the sidecar mounts the log volumes of the container
+// of the given name below.
+func (n NamesConfig) logMountDir(containerName string) string {
+	return filepath.Clean(n.LogMountPrefix + containerName)
 }
 
 type InjectorConfig struct {
@@ -48,13 +160,45 @@ type InjectorConfig struct {
 	SidecarConfig          SidecarConfig
 	FilebeatConfigTemplate *template.Template
 	VectorConfigTemplate   *template.Template
+	// Hash identifies the config by its content
+	Hash string
+	// Generation numbers the configs in the order they were loaded
+	Generation int64
+	LoadTime   time.Time
+
+	sidecarContent  []byte
+	templateContent []byte
+}
+
+// names returns the names of the parts ic injects.
+func (ic *InjectorConfig) names() NamesConfig {
+	return ic.SidecarConfig.Names.withDefaults()
 }
 
 func (c *Config) AddFlags() {
+	flag.StringVar(&c.ListenAddress, "listen-address", ":8443", "Address to serve the webhook at.")
 	flag.StringVar(&c.CertFile, "tls-cert-file", "/etc/logsidecar-injector/certs/server.crt",
 		"File containing the default x509 Certificate for HTTPS. (CA cert, if any, concatenated after server cert).")
 	flag.StringVar(&c.KeyFile, "tls-private-key-file", "/etc/logsidecar-injector/certs/server.key",
 		"File containing the default x509 private key matching --tls-cert-file.")
+	flag.StringVar(&c.ClientCAFile, "client-ca-file", "",
+		"File containing the CA certificates to verify client certificates of the webhook with, e.g. the one of the kube-apiserver. Clients without a valid certificate are refused.")
+	flag.StringVar(&c.AllowedClientNames, "allowed-client-names", "",
+		"Comma-separated list of common names or subject alternative names of the client certificates allowed to call the webhook. Requires --client-ca-file. If omitted, any client verified by the CA is allowed.")
+	flag.StringVar(&c.TLSMinVersion, "tls-min-version", "VersionTLS12",
+		"Minimum TLS version of the webhook and admin servers. Supported values: VersionTLS12, VersionTLS13")
+	flag.StringVar(&c.TLSCipherSuites, "tls-cipher-suites", "",
+		"Comma-separated list of cipher suites of the webhook and admin servers for TLS 1.2, e.g. TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256. "+
+			"If omitted, the default Go cipher suites will be used.")
+	flag.StringVar(&c.TLSCurvePreferences, "tls-curve-preferences", "",
+		"Comma-separated list of elliptic curves of the webhook and admin servers in order of preference. Supported values: X25519, CurveP256, CurveP384, CurveP521")
+	flag.BoolVar(&c.HTTP2, "http2", true, "Enable HTTP/2 for the webhook and admin servers.")
+	flag.DurationVar(&c.ReadTimeout, "read-timeout", 10*time.Second,
+		"Maximum duration of reading a request to the webhook and admin servers.")
+	flag.DurationVar(&c.WriteTimeout, "write-timeout", 30*time.Second,
+		"Maximum duration from reading the headers of a request to writing the response of the webhook and admin servers.")
+	flag.DurationVar(&c.IdleTimeout, "idle-timeout", 120*time.Second,
+		"Maximum duration of idle keep-alive connections to the webhook and admin servers.")
 	flag.StringVar(&c.SidecarType, "sidecar-type", SidecarTypeVector, "Type of sidecar to inject. Supported values: filebeat, vector")
 	flag.StringVar(&c.SidecarConfigFile, "sidecar-config-file", "/etc/logsidecar-injector/config/sidecar.yaml",
 		"File containing config of injected containers etc.")
@@ -62,25 +206,83 @@ func (c *Config) AddFlags() {
 		"File containing filebeat config")
 	flag.StringVar(&c.VectorConfigFile, "vector-config-file", "/etc/logsidecar-injector/config/vector.yaml",
 		"File containing vector config")
+	flag.StringVar(&c.AdminAddress, "admin-address", ":9443",
+		"Address to serve the admin endpoints /-/reload, /-/config, /-/rollback and /metrics at, e.g. 127.0.0.1:9443 to serve them locally only.")
+	flag.StringVar(&c.AdminTokenFile, "admin-token-file", "",
+		"File containing a bearer token required by the admin endpoints.")
+	flag.BoolVar(&c.AdminKubernetesAuth, "admin-kubernetes-auth", false,
+		"Require a bearer token of Kubernetes authorized to the admin endpoint by a SubjectAccessReview, e.g. to verb post of non-resource url /-/reload.")
+	flag.BoolVar(&c.AdminLoopbackReload, "admin-loopback-reload", false,
+		"Allow POST /-/reload from loopback addresses without a bearer token, e.g. by the config reloader of the injector pod, which can't send one. "+
+			"Unsafe if a sidecar proxy, e.g. of a service mesh, forwards requests of other pods from a loopback address.")
+	flag.StringVar(&c.AdminCertFile, "admin-tls-cert-file", "",
+		"File containing the x509 Certificate to serve the admin endpoints over HTTPS with.")
+	flag.StringVar(&c.AdminKeyFile, "admin-tls-private-key-file", "",
+		"File containing the x509 private key matching --admin-tls-cert-file.")
+	flag.StringVar(&c.AdminClientCAFile, "admin-client-ca-file", "",
+		"File containing the CA certificates to verify client certificates of the admin endpoints with. Clients without a valid certificate are refused.")
+	flag.StringVar(&c.AuditLogPath, "audit-log-path", "",
+		"File to write the audit log of admissions to as json lines, or - for stdout. If omitted, no audit log is written.")
+	flag.IntVar(&c.AuditLogMaxSize, "audit-log-max-size", 100,
+		"Maximum size in megabytes of the audit log file before it is rotated. 0 disables rotation.")
+	flag.IntVar(&c.AuditLogMaxBackups, "audit-log-max-backups", 5,
+		"Number of rotated audit log files to keep.")
+	flag.Float64Var(&c.AuditLogSampleRate, "audit-log-sample-rate", 1,
+		"Fraction between 0 and 1 of the allowed admissions to audit. Denied admissions are always audited.")
+	flag.StringVar(&c.AuditLogRedactAnnotations, "audit-log-redact-annotations",
+		strings.Join([]string{logsidecarSinkAnnotationName, logsidecarFilebeatPatchAnnotationName, logsidecarVectorPatchAnnotationName}, ","),
+		"Comma-separated list of pod annotations whose values are redacted in the audit log.")
+	flag.StringVar(&c.TracingEndpoint, "tracing-endpoint", "",
+		"Host and port of an OTLP/HTTP collector to export the traces of admissions to, e.g. otel-collector:4318. If omitted, tracing is disabled.")
+	flag.BoolVar(&c.TracingInsecure, "tracing-insecure", false, "Export traces over plain http instead of https.")
+	flag.Float64Var(&c.TracingSampleRatio, "tracing-sample-ratio", 1,
+		"Fraction between 0 and 1 of the admissions to trace, unless the apiserver propagates its sampling decision.")
+	flag.StringVar(&c.Kubeconfig, "kubeconfig", "",
+		"Path to a kubeconfig. Only required if out-of-cluster.")
+	flag.BoolVar(&c.DriftDetection, "drift-detection", false,
+		"Detect pods whose logsidecar was injected with a stale config, and expose them as metrics and events.")
+	flag.DurationVar(&c.DriftDetectionInterval, "drift-detection-interval", 5*time.Minute,
+		"Interval of detecting pods with a stale logsidecar config.")
+	flag.BoolVar(&c.DriftRolloutRestart, "drift-rollout-restart", false,
+		"Restart deployments, statefulsets and daemonsets with pods with a stale logsidecar config.")
+	flag.BoolVar(&c.LeaderElection, "leader-election", true,
+		"Run the drift detection only in the replica elected leader. Disable it only with a single replica.")
+	flag.StringVar(&c.LeaderElectionNamespace, "leader-election-namespace", "",
+		"Namespace of the leader election lease. Defaults to the namespace of the service account.")
+	flag.StringVar(&c.LeaderElectionLeaseName, "leader-election-lease-name", "logsidecar-injector",
+		"Name of the leader election lease.")
 }
 
 func (c *Config) TLSConfig(stop <-chan struct{}, reloadCh <-chan chan error) (*tls.Config, error) {
+	tlsConfig, err := c.serverTLSConfig()
+	if err != nil {
+		return nil, err
+	}
 	sCert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
 	if err != nil {
 		return nil, err
 	}
+	clientCAs, err := c.clientCAs()
+	if err != nil {
+		return nil, err
+	}
 	var m sync.Mutex
 	go func() {
 		for {
 			select {
 			case errc := <-reloadCh:
 				cert, e := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+				var cas *x509.CertPool
+				if e == nil {
+					cas, e = c.clientCAs()
+				}
 				errc <- e
 				if e == nil {
 					func() {
 						m.Lock()
 						defer m.Unlock()
 						sCert = cert
+						clientCAs = cas
 					}()
 				}
 			case <-stop:
@@ -88,25 +290,208 @@ func (c *Config) TLSConfig(stop <-chan struct{}, reloadCh <-chan chan error) (*t
 			}
 		}
 	}()
-	return &tls.Config{
-		GetCertificate: func(_ *tls.ClientHelloInfo) (cert *tls.Certificate, e error) {
-			m.Lock()
-			defer m.Unlock()
-			return &sCert, nil
-		},
-	}, nil
+	tlsConfig.GetCertificate = func(_ *tls.ClientHelloInfo) (cert *tls.Certificate, e error) {
+		m.Lock()
+		defer m.Unlock()
+		return &sCert, nil
+	}
+	if clientCAs == nil {
+		if len(splitList(c.AllowedClientNames)) > 0 {
+			return nil, fmt.Errorf("allowed client names require a client CA")
+		}
+		return tlsConfig, nil
+	}
+
+	// verify clients against the current CAs
+	allowed := splitList(c.AllowedClientNames)
+	tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	tlsConfig.VerifyConnection = func(cs tls.ConnectionState) error {
+		return verifyClientName(cs, allowed)
+	}
+	baseConfig := tlsConfig.Clone()
+	tlsConfig.GetConfigForClient = func(_ *tls.ClientHelloInfo) (*tls.Config, error) {
+		m.Lock()
+		defer m.Unlock()
+		config := baseConfig.Clone()
+		config.ClientCAs = clientCAs
+		return config, nil
+	}
+	return tlsConfig, nil
 }
 
-func sidecarConfig(sidecarConfigFile string) (*SidecarConfig, error) {
+// clientCAs returns the CAs to verify the clients of the webhook with, or nil if any
+// client is accepted.
+func (c *Config) clientCAs() (*x509.CertPool, error) {
+	if c.ClientCAFile == "" {
+		return nil, nil
+	}
+	ca, err := ioutil.ReadFile(c.ClientCAFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("no certificates found in %s", c.ClientCAFile)
+	}
+	return pool, nil
+}
+
+// verifyClientName checks that the verified client certificate of cs has the common
+// name or a subject alternative name allowed, if any names are allowed.
+func verifyClientName(cs tls.ConnectionState, allowed []string) error {
+	if len(allowed) == 0 {
+		return nil
+	}
+	if len(cs.VerifiedChains) == 0 || len(cs.VerifiedChains[0]) == 0 {
+		return fmt.Errorf("client certificate required")
+	}
+	cert := cs.VerifiedChains[0][0]
+	names := append([]string{cert.Subject.CommonName}, cert.DNSNames...)
+	names = append(names, cert.EmailAddresses...)
+	for _, ip := range cert.IPAddresses {
+		names = append(names, ip.String())
+	}
+	for _, uri := range cert.URIs {
+		names = append(names, uri.String())
+	}
+	for _, name := range names {
+		for _, a := range allowed {
+			if name != "" && name == a {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("client certificate %q not allowed", cert.Subject.CommonName)
+}
+
+func sidecarConfig(sidecarConfigFile string) (*SidecarConfig, []byte, error) {
 	var sidecarConfig SidecarConfig
 	scontent, err := ioutil.ReadFile(sidecarConfigFile)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	if err = yaml.Unmarshal(scontent, &sidecarConfig); err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-	return &sidecarConfig, nil
+	return &sidecarConfig, scontent, nil
+}
+
+// validateNames checks that the names of sc are valid names of containers, volumes and
+// directories, and that the injected parts don't collide with each other.
+func validateNames(sc *SidecarConfig) error {
+	names := sc.Names.withDefaults()
+	for _, n := range []struct{ field, name string }{
+		{"initContainer", names.InitContainer},
+		{"container", names.Container},
+		{"configVolume", names.ConfigVolume},
+		{"sinkVolume", names.SinkVolume},
+		{"checkpointVolume", names.CheckpointVolume},
+	} {
+		if errs := validation.IsDNS1123Label(n.name); len(errs) > 0 {
+			return fmt.Errorf("names.%s %s is invalid: %s", n.field, n.name, strings.Join(errs, "; "))
+		}
+	}
+	if names.InitContainer == names.Container {
+		return fmt.Errorf("names.initContainer and names.container are both %s", names.Container)
+	}
+	if names.ConfigVolume == names.SinkVolume || names.ConfigVolume == names.CheckpointVolume {
+		return fmt.Errorf("names.configVolume %s is not distinct from the other volumes", names.ConfigVolume)
+	}
+	if names.SinkVolume == names.CheckpointVolume {
+		return fmt.Errorf("names.sinkVolume and names.checkpointVolume are both %s", names.SinkVolume)
+	}
+	for _, d := range []struct{ field, dir string }{{"configDir", names.ConfigDir}, {"dataDir", names.DataDir}} {
+		if !filepath.IsAbs(d.dir) || filepath.Clean(d.dir) == "/" {
+			return fmt.Errorf("names.%s %s is not an absolute path below /", d.field, d.dir)
+		}
+	}
+	if configDir, dataDir := filepath.Clean(names.ConfigDir), filepath.Clean(names.DataDir); configDir == dataDir || pathOverlaps(configDir, dataDir) {
+		return fmt.Errorf("names.dataDir %s overlaps names.configDir %s", names.DataDir, names.ConfigDir)
+	}
+	if !filepath.IsAbs(names.LogMountPrefix) || filepath.Clean(names.LogMountPrefix) == "/" {
+		return fmt.Errorf("names.logMountPrefix %s is not an absolute path below /", names.LogMountPrefix)
+	}
+	// the log volumes of some container would be mounted at or above these directories
+	for _, dir := range []string{filepath.Clean(names.ConfigDir), filepath.Clean(names.DataDir), logsidecarSinkTLSDir} {
+		if strings.HasPrefix(dir, names.LogMountPrefix) || strings.HasPrefix(names.LogMountPrefix, dir+"/") {
+			return fmt.Errorf("names.logMountPrefix %s overlaps directory %s of the sidecar", names.LogMountPrefix, dir)
+		}
+	}
+	return nil
+}
+
+func validateSidecarVolumes(sc *SidecarConfig) error {
+	names := sc.Names.withDefaults()
+	volumes := map[string]bool{}
+	for _, v := range sc.Volumes {
+		if v.Name == "" {
+			return fmt.Errorf("volumes require name")
+		}
+		if v.Name == names.ConfigVolume || v.Name == names.SinkVolume || v.Name == names.CheckpointVolume || volumes[v.Name] {
+			return fmt.Errorf("volume %s duplicated", v.Name)
+		}
+		volumes[v.Name] = true
+	}
+	for name, cc := range map[string]ContainerConfig{
+		"initContainer":     sc.InitContainer,
+		"filebeatContainer": sc.FilebeatContainer,
+		"vectorContainer":   sc.VectorContainer,
+	} {
+		for _, vm := range cc.VolumeMounts {
+			if !volumes[vm.Name] {
+				return fmt.Errorf("volume %s mounted by %s not found in volumes", vm.Name, name)
+			}
+		}
+	}
+	return nil
+}
+
+func configTemplate(configFile string) (*template.Template, []byte, error) {
+	content, err := ioutil.ReadFile(configFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	tmpl, err := template.New(filepath.Base(configFile)).Funcs(templateFuncs()).Parse(string(content))
+	if err != nil {
+		return nil, nil, fmt.Errorf("error to parse %s to tempalte: %v", configFile, err)
+	}
+	return tmpl, content, nil
+}
+
+// dryRunInjectorConfig renders the sidecar config for a synthetic pod, so templates
+// failing at execution or rendering invalid yaml are found before any pod is admitted.
+func dryRunInjectorConfig(ic *InjectorConfig) error {
+	pod := &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "logsidecar-dry-run",
+			Namespace:   "default",
+			Labels:      map[string]string{"app": "logsidecar-dry-run"},
+			Annotations: map[string]string{},
+		},
+		Spec: v1.PodSpec{
+			Containers: []v1.Container{{
+				Name:         "app",
+				VolumeMounts: []v1.VolumeMount{{Name: "logs", MountPath: "/var/log/app"}},
+			}},
+			Volumes: []v1.Volume{{Name: "logs", VolumeSource: v1.VolumeSource{EmptyDir: &v1.EmptyDirVolumeSource{}}}},
+		},
+	}
+	names := ic.names()
+	sc, _, _, _ := sinkPart(ic.SidecarConfig.Sink, names)
+	logPaths := []string{filepath.Join(names.logMountDir("app"), "var/log/app/*.log")}
+	configYaml, configFile, err := renderSidecarConfig(context.Background(), ic, pod, logPaths, sc)
+	if err != nil {
+		return fmt.Errorf("dry-run rendering of %s failed: %v", configFile, err)
+	}
+	configJson, err := yaml.YAMLToJSONStrict([]byte(configYaml))
+	if err != nil {
+		return fmt.Errorf("dry-run rendering of %s is invalid yaml: %v", configFile, err)
+	}
+	var config map[string]interface{}
+	if err = json.Unmarshal(configJson, &config); err != nil || len(config) == 0 {
+		return fmt.Errorf("dry-run rendering of %s is not a yaml mapping", configFile)
+	}
+	return nil
 }
 
 func (c *Config) InjectorConfig() (*InjectorConfig, error) {
@@ -114,25 +499,28 @@ func (c *Config) InjectorConfig() (*InjectorConfig, error) {
 		SidecarType: c.SidecarType,
 	}
 
-	sc, err := sidecarConfig(c.SidecarConfigFile)
+	sc, scontent, err := sidecarConfig(c.SidecarConfigFile)
 	if err != nil {
 		return nil, err
 	}
 	ic.SidecarConfig = *sc
 
+	var tcontent []byte
 	if c.SidecarType == SidecarTypeVector {
-		vectorTmpl, err := template.ParseFiles(c.VectorConfigFile)
+		var vectorTmpl *template.Template
+		vectorTmpl, tcontent, err = configTemplate(c.VectorConfigFile)
 		if err != nil {
-			return nil, fmt.Errorf("error to parse %s to tempalte: %v", c.VectorConfigFile, err)
+			return nil, err
 		}
 		ic.VectorConfigTemplate = vectorTmpl
 		if ic.SidecarConfig.VectorContainer.Image == "" {
 			ic.SidecarConfig.VectorContainer.Image = SidecarContainerDefaultVectorImage
 		}
 	} else if c.SidecarType == SidecarTypeFilebeat {
-		filebeatTmpl, err := template.ParseFiles(c.FilebeatConfigFile)
+		var filebeatTmpl *template.Template
+		filebeatTmpl, tcontent, err = configTemplate(c.FilebeatConfigFile)
 		if err != nil {
-			return nil, fmt.Errorf("error to parse %s to tempalte: %v", c.FilebeatConfigFile, err)
+			return nil, err
 		}
 		ic.FilebeatConfigTemplate = filebeatTmpl
 		if ic.SidecarConfig.FilebeatContainer.Image == "" {
@@ -142,9 +530,34 @@ func (c *Config) InjectorConfig() (*InjectorConfig, error) {
 		return nil, fmt.Errorf("sidecar type %s not supported", c.SidecarType)
 	}
 
+	if err = validateSink(c.SidecarType, ic.SidecarConfig.Sink); err != nil {
+		return nil, err
+	}
+	if err = validateNames(&ic.SidecarConfig); err != nil {
+		return nil, err
+	}
+	if err = validateCheckpoint(&ic.SidecarConfig.Checkpoint); err != nil {
+		return nil, err
+	}
+	if err = validateSidecarVolumes(&ic.SidecarConfig); err != nil {
+		return nil, err
+	}
+
 	if ic.SidecarConfig.InitContainer.Image == "" {
 		ic.SidecarConfig.InitContainer.Image = SidecarInitContainerDefaultImage
 	}
 
+	if err = dryRunInjectorConfig(ic); err != nil {
+		return nil, err
+	}
+
+	h := sha256.New()
+	for _, content := range [][]byte{[]byte(c.SidecarType), scontent, tcontent} {
+		fmt.Fprintf(h, "%d:%s", len(content), content)
+	}
+	ic.Hash = hex.EncodeToString(h.Sum(nil))
+	ic.sidecarContent = scontent
+	ic.templateContent = tcontent
+
 	return ic, nil
 }
@@ -1,15 +1,30 @@
 package injector
 
 import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
 	"io/ioutil"
 	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/google/go-cmp/cmp"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
 	v1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/util/clock"
 	"sigs.k8s.io/yaml"
 )
 
@@ -21,8 +36,8 @@ func TestSidecarConfig(t *testing.T) {
 	defer os.RemoveAll(tempDir)
 
 	var config = SidecarConfig{
-		Container: ContainerConfig{
-			Image:           SidecarContainerDefaultImage,
+		FilebeatContainer: ContainerConfig{
+			Image:           SidecarContainerDefaultFilebeatImage,
 			ImagePullPolicy: v1.PullIfNotPresent,
 			Resources: v1.ResourceRequirements{
 				Requests: v1.ResourceList{
@@ -56,7 +71,7 @@ func TestSidecarConfig(t *testing.T) {
 	}
 	ioutil.WriteFile(filepath.Join(tempDir, "sidecar.yaml"), scBytes, 0644)
 
-	gotSidecarConfig, err := sidecarConfig(filepath.Join(tempDir, "sidecar.yaml"))
+	gotSidecarConfig, _, err := sidecarConfig(filepath.Join(tempDir, "sidecar.yaml"))
 	if err != nil {
 		t.Fatal("parse sidecar config: ", err)
 	}
@@ -66,3 +81,389 @@ func TestSidecarConfig(t *testing.T) {
 	}
 
 }
+
+func TestValidateSidecarVolumes(t *testing.T) {
+	tests := []struct {
+		name   string
+		config SidecarConfig
+		valid  bool
+	}{{
+		name: "mounted volume",
+		config: SidecarConfig{
+			VectorContainer: ContainerConfig{VolumeMounts: []v1.VolumeMount{{Name: "certs", MountPath: "/etc/certs"}}},
+			Volumes:         []v1.Volume{{Name: "certs"}},
+		},
+		valid: true,
+	}, {
+		name: "missing volume",
+		config: SidecarConfig{
+			InitContainer: ContainerConfig{VolumeMounts: []v1.VolumeMount{{Name: "certs", MountPath: "/etc/certs"}}},
+		},
+	}, {
+		name:   "duplicated volume",
+		config: SidecarConfig{Volumes: []v1.Volume{{Name: "certs"}, {Name: "certs"}}},
+	}, {
+		name:   "reserved volume",
+		config: SidecarConfig{Volumes: []v1.Volume{{Name: logsidecarVolumeName}}},
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateSidecarVolumes(&tt.config)
+			if (err == nil) != tt.valid {
+				t.Fatalf("expected valid %v, got %v", tt.valid, err)
+			}
+		})
+	}
+}
+
+func TestValidateNames(t *testing.T) {
+	tests := []struct {
+		name  string
+		names NamesConfig
+		valid bool
+	}{{
+		name:  "defaults",
+		valid: true,
+	}, {
+		name: "custom",
+		names: NamesConfig{InitContainer: "log-init", Container: "log", ConfigVolume: "log-config",
+			SinkVolume: "log-sink", ConfigDir: "/etc/log", LogMountPrefix: "/logs/"},
+		valid: true,
+	}, {
+		name:  "invalid container name",
+		names: NamesConfig{Container: "Logsidecar"},
+	}, {
+		name:  "invalid volume name",
+		names: NamesConfig{ConfigVolume: "config.volume"},
+	}, {
+		name:  "too long name",
+		names: NamesConfig{InitContainer: strings.Repeat("a", 64)},
+	}, {
+		name:  "same container names",
+		names: NamesConfig{InitContainer: "log", Container: "log"},
+	}, {
+		name:  "same volume names",
+		names: NamesConfig{ConfigVolume: "log", SinkVolume: "log"},
+	}, {
+		name:  "relative config dir",
+		names: NamesConfig{ConfigDir: "etc/log"},
+	}, {
+		name:  "root log mount prefix",
+		names: NamesConfig{LogMountPrefix: "/"},
+	}, {
+		name:  "config dir below log mounts",
+		names: NamesConfig{LogMountPrefix: "/etc/"},
+	}, {
+		name:  "same data and config dir",
+		names: NamesConfig{DataDir: "/etc/logsidecar/"},
+	}, {
+		name:  "data dir below config dir",
+		names: NamesConfig{DataDir: "/etc/logsidecar/data"},
+	}, {
+		name:  "same checkpoint and config volume",
+		names: NamesConfig{CheckpointVolume: logsidecarVolumeName},
+	}, {
+		name:  "log mounts below config dir",
+		names: NamesConfig{LogMountPrefix: "/etc/logsidecar/container-"},
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateNames(&SidecarConfig{Names: tt.names})
+			if (err == nil) != tt.valid {
+				t.Fatalf("expected valid %v, got %v", tt.valid, err)
+			}
+		})
+	}
+	assert.Error(t, validateSidecarVolumes(&SidecarConfig{
+		Names:   NamesConfig{ConfigVolume: "certs"},
+		Volumes: []v1.Volume{{Name: "certs"}},
+	}))
+}
+
+func TestConfigStoreReloadDryRun(t *testing.T) {
+	dir := t.TempDir()
+	c := &Config{
+		SidecarType:       SidecarTypeVector,
+		SidecarConfigFile: filepath.Join(dir, "sidecar.yaml"),
+		VectorConfigFile:  filepath.Join(dir, "vector.yaml"),
+	}
+	writeVectorTemplate := func(content string) {
+		if err := ioutil.WriteFile(c.VectorConfigFile, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(c.SidecarConfigFile, []byte("vectorContainer: {}\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	metrics := NewMetrics()
+	store := NewConfigStore(c, clock.RealClock{}, metrics)
+
+	writeVectorTemplate("sources:\n  logs:\n    include:\n{{range .Paths}}    - {{quote .}}\n{{end}}")
+	if err := store.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	good := store.Get()
+	assert.Equal(t, float64(1), testutil.ToFloat64(metrics.configLastReloadSuccessful))
+
+	for name, content := range map[string]string{
+		"execution error": "sources: {{index .Paths 1}}\n",
+		"unknown field":   "sources: {{.Unknown}}\n",
+		"invalid yaml":    "sources: [{{range .Paths}}{{.}}{{end}}\n",
+		"duplicated keys": "sources: a\nsources: b\n",
+		"not a mapping":   "{{range .Paths}}- {{.}}{{end}}\n",
+		"empty":           "",
+	} {
+		t.Run(name, func(t *testing.T) {
+			writeVectorTemplate(content)
+			failures := testutil.ToFloat64(metrics.configReloads.WithLabelValues("failure"))
+			err := store.Reload()
+			assert.Error(t, err)
+			assert.Contains(t, err.Error(), "dry-run rendering of vector.yaml")
+			assert.Same(t, good, store.Get())
+			assert.Equal(t, float64(0), testutil.ToFloat64(metrics.configLastReloadSuccessful))
+			assert.Equal(t, failures+1, testutil.ToFloat64(metrics.configReloads.WithLabelValues("failure")))
+		})
+	}
+}
+
+func TestConfigStoreConcurrentReloads(t *testing.T) {
+	dir := t.TempDir()
+	c := &Config{
+		SidecarType:       SidecarTypeVector,
+		SidecarConfigFile: filepath.Join(dir, "sidecar.yaml"),
+		VectorConfigFile:  filepath.Join(dir, "vector.yaml"),
+	}
+	if err := ioutil.WriteFile(c.VectorConfigFile, []byte("sources: {}\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// writeVersion replaces the sidecar config atomically, as kubelet updates configmaps
+	writeVersion := func(version int) {
+		tmp := c.SidecarConfigFile + ".tmp"
+		content := fmt.Sprintf("vectorContainer:\n  image: vector:%d\n", version)
+		if err := ioutil.WriteFile(tmp, []byte(content), 0644); err != nil {
+			t.Error(err)
+			return
+		}
+		if err := os.Rename(tmp, c.SidecarConfigFile); err != nil {
+			t.Error(err)
+		}
+	}
+	version := func(sc SidecarConfig) int {
+		v, _ := strconv.Atoi(strings.TrimPrefix(sc.VectorContainer.Image, "vector:"))
+		return v
+	}
+
+	writeVersion(0)
+	s := NewConfigStore(c, clock.RealClock{}, NewMetrics())
+	// the configs of later generations were read later, so are no older
+	checkHistory := func() bool {
+		status := s.Status(true)
+		for i := 1; i < len(status.History); i++ {
+			prev, cur := status.History[i-1], status.History[i]
+			if version(*cur.SidecarConfig) < version(*prev.SidecarConfig) {
+				t.Errorf("generation %d has an older config than generation %d", cur.Generation, prev.Generation)
+				return false
+			}
+		}
+		return true
+	}
+
+	const versions = 500
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				if err := s.Reload(); err != nil {
+					t.Error(err)
+					return
+				}
+				if !checkHistory() {
+					return
+				}
+			}
+		}()
+	}
+	for v := 1; v <= versions; v++ {
+		writeVersion(v)
+	}
+	close(stop)
+	wg.Wait()
+
+	assert.NoError(t, s.Reload())
+	assert.Equal(t, versions, version(s.Get().SidecarConfig))
+}
+
+func TestConfigStoreHistory(t *testing.T) {
+	dir := t.TempDir()
+	c := &Config{
+		SidecarType:       SidecarTypeVector,
+		SidecarConfigFile: filepath.Join(dir, "sidecar.yaml"),
+		VectorConfigFile:  filepath.Join(dir, "vector.yaml"),
+	}
+	if err := ioutil.WriteFile(c.SidecarConfigFile, []byte("vectorContainer: {}\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	writeVectorTemplate := func(content string) {
+		if err := ioutil.WriteFile(c.VectorConfigFile, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fakeClock := clock.NewFakeClock(time.Date(2021, 7, 1, 0, 0, 0, 0, time.UTC))
+	metrics := NewMetrics()
+	store := NewConfigStore(c, fakeClock, metrics)
+
+	_, err := store.Rollback()
+	assert.Error(t, err)
+
+	writeVectorTemplate("sources: {}\n")
+	assert.NoError(t, store.Reload())
+	first := store.Get()
+	fakeClock.Step(time.Minute)
+	writeVectorTemplate("sources: {}\nsinks: {}\n")
+	assert.NoError(t, store.Reload())
+	second := store.Get()
+	writeVectorTemplate("sources: [\n")
+	assert.Error(t, store.Reload())
+
+	assert.Equal(t, first.Generation+1, second.Generation)
+	assert.NotEqual(t, first.Hash, second.Hash)
+	assert.Equal(t, time.Minute, second.LoadTime.Sub(first.LoadTime))
+
+	status := store.Status(true)
+	assert.Equal(t, second.Generation, status.Active.Generation)
+	assert.Equal(t, "sources: {}\nsinks: {}\n", status.Active.Template)
+	assert.Len(t, status.History, 2)
+	assert.Empty(t, status.History[0].Template)
+	// the contents are left out unless requested
+	status = store.Status(false)
+	assert.Equal(t, second.Hash, status.Active.Hash)
+	assert.Nil(t, status.Active.SidecarConfig)
+	assert.Empty(t, status.Active.Sidecar)
+	assert.Empty(t, status.Active.Template)
+	assert.Nil(t, status.History[1].SidecarConfig)
+	assert.Len(t, status.Attempts, 4)
+	last := status.Attempts[len(status.Attempts)-1]
+	assert.Equal(t, "reload", last.Action)
+	assert.Contains(t, last.Error, "invalid yaml")
+	assert.Zero(t, last.Generation)
+
+	assert.Equal(t, float64(second.Generation), testutil.ToFloat64(metrics.configGeneration))
+	assert.Equal(t, float64(1), testutil.ToFloat64(metrics.configInfo.WithLabelValues(second.Hash)))
+
+	ic, err := store.Rollback()
+	assert.NoError(t, err)
+	assert.Same(t, first, ic)
+	assert.Same(t, first, store.Get())
+	// the metrics and the status show the generation rolled back to
+	assert.Equal(t, float64(first.Generation), testutil.ToFloat64(metrics.configGeneration))
+	assert.Equal(t, 1, testutil.CollectAndCount(metrics.configInfo))
+	assert.Equal(t, float64(1), testutil.ToFloat64(metrics.configInfo.WithLabelValues(first.Hash)))
+	status = store.Status(false)
+	assert.Equal(t, first.Generation, status.Active.Generation)
+	assert.Len(t, status.History, 1)
+	last = status.Attempts[len(status.Attempts)-1]
+	assert.Equal(t, ReloadAttempt{Time: last.Time, Action: "rollback", Generation: first.Generation, Hash: first.Hash}, last)
+	_, err = store.Rollback()
+	assert.Error(t, err)
+	assert.Equal(t, float64(1), testutil.ToFloat64(metrics.configRollbacks.WithLabelValues("success")))
+	assert.Equal(t, float64(2), testutil.ToFloat64(metrics.configRollbacks.WithLabelValues("failure")))
+
+	// a reload after rollback starts a new generation
+	writeVectorTemplate("sources: {}\n")
+	assert.NoError(t, store.Reload())
+	assert.Equal(t, second.Generation+1, store.Get().Generation)
+	assert.Equal(t, first.Hash, store.Get().Hash)
+	assert.Equal(t, float64(second.Generation+1), testutil.ToFloat64(metrics.configGeneration))
+}
+
+func TestTLSConfigClientVerification(t *testing.T) {
+	dir := t.TempDir()
+	ca := writeCert(t, dir, "ca", nil)
+	writeCert(t, dir, "server", &ca)
+	apiserver := writeCert(t, dir, "kube-apiserver", &ca)
+	other := writeCert(t, dir, "other", &ca)
+	otherCA := writeCert(t, dir, "other-ca", nil)
+	otherCAClient := writeCert(t, dir, "kube-aggregator", &otherCA)
+
+	c := &Config{
+		CertFile:           filepath.Join(dir, "server.crt"),
+		KeyFile:            filepath.Join(dir, "server.key"),
+		ClientCAFile:       filepath.Join(dir, "ca.crt"),
+		AllowedClientNames: "kube-apiserver, kube-aggregator",
+	}
+	stop := make(chan struct{})
+	defer close(stop)
+	reloadCh := make(chan chan error)
+	tlsConfig, err := c.TLSConfig(stop, reloadCh)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	server.TLS = tlsConfig
+	server.StartTLS()
+	defer server.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Leaf)
+	get := func(certs ...tls.Certificate) error {
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots, Certificates: certs}}}
+		resp, err := client.Get(server.URL)
+		if err == nil {
+			resp.Body.Close()
+		}
+		return err
+	}
+	assert.NoError(t, get(apiserver))
+	assert.Error(t, get(other), "name not allowed")
+	assert.Error(t, get(otherCAClient), "unknown CA")
+	assert.Error(t, get(), "no client certificate")
+
+	// the client CA is reloaded along with the certs
+	content, err := ioutil.ReadFile(filepath.Join(dir, "other-ca.crt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(c.ClientCAFile, content, 0600); err != nil {
+		t.Fatal(err)
+	}
+	errc := make(chan error)
+	reloadCh <- errc
+	assert.NoError(t, <-errc)
+	assert.NoError(t, get(otherCAClient))
+	assert.Error(t, get(apiserver), "CA replaced")
+
+	_, err = (&Config{CertFile: c.CertFile, KeyFile: c.KeyFile, AllowedClientNames: "kube-apiserver"}).TLSConfig(stop, reloadCh)
+	assert.Error(t, err, "allowed client names without client CA")
+}
+
+func TestVerifyClientName(t *testing.T) {
+	spiffe, _ := url.Parse("spiffe://cluster.local/ns/kube-system/sa/aggregator")
+	cert := &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "apiserver"},
+		DNSNames:    []string{"kube-apiserver.kube-system.svc"},
+		IPAddresses: []net.IP{net.ParseIP("10.0.0.1")},
+		URIs:        []*url.URL{spiffe},
+	}
+	cs := tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}
+	for allowed, valid := range map[string]bool{
+		"":                               true,
+		"apiserver":                      true,
+		"kube-apiserver.kube-system.svc": true,
+		"10.0.0.1":                       true,
+		spiffe.String():                  true,
+		"kube-apiserver":                 false,
+		"other,apiserver":                true,
+	} {
+		err := verifyClientName(cs, splitList(allowed))
+		assert.Equal(t, valid, err == nil, allowed)
+	}
+	assert.Error(t, verifyClientName(tls.ConnectionState{}, []string{"apiserver"}))
+}
@@ -0,0 +1,203 @@
+package injector
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/klog"
+)
+
+const (
+	restartedAtAnnotationName  = "kubectl.kubernetes.io/restartedAt"
+	restartedForAnnotationName = "logging.kubesphere.io/logsidecar-restarted-for"
+
+	driftEventReason = "LogsidecarConfigDrift"
+)
+
+// DriftController detects pods whose logsidecar was injected with another generation
+// of the injector config than the current one, e.g. after the templates were reloaded.
+// Drifted workloads are exposed as metrics and events, and optionally restarted.
+type DriftController struct {
+	injector       *Injector
+	client         kubernetes.Interface
+	recorder       record.EventRecorder
+	rolloutRestart bool
+	// pods lists the injected pods from the cache of an informer
+	pods corelisters.PodLister
+	// drifted holds the workloads found drifted by the last detection
+	drifted map[corev1.ObjectReference]int
+}
+
+func NewDriftController(injector *Injector, client kubernetes.Interface, rolloutRestart bool) *DriftController {
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: client.CoreV1().Events("")})
+	return &DriftController{
+		injector:       injector,
+		client:         client,
+		recorder:       broadcaster.NewRecorder(injector.scheme, corev1.EventSource{Component: "logsidecar-injector"}),
+		rolloutRestart: rolloutRestart,
+		drifted:        make(map[corev1.ObjectReference]int),
+	}
+}
+
+// Run watches the injected pods, and detects drifted ones every interval until stop is
+// closed. It may be run again after stop was closed, e.g. when elected leader again.
+func (d *DriftController) Run(interval time.Duration, stop <-chan struct{}) {
+	if !d.startInformer(stop) {
+		return
+	}
+	wait.Until(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), interval)
+		defer cancel()
+		if err := d.Detect(ctx); err != nil {
+			klog.Errorf("failed to detect drifted pods: %v", err)
+		}
+	}, interval, stop)
+}
+
+// startInformer starts an informer of the pods labeled injected, and waits until its
+// cache is synced. It returns false if stop is closed before.
+func (d *DriftController) startInformer(stop <-chan struct{}) bool {
+	factory := informers.NewSharedInformerFactoryWithOptions(d.client, 0,
+		informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+			options.LabelSelector = logsidecarInjectedLabelName + "=true"
+		}))
+	pods := factory.Core().V1().Pods()
+	d.pods = pods.Lister()
+	factory.Start(stop)
+	for _, synced := range factory.WaitForCacheSync(stop) {
+		if !synced {
+			return false
+		}
+	}
+	return true
+}
+
+// Detect lists the injected pods and compares the hash of the injector config they were
+// injected with to the one of the current config.
+func (d *DriftController) Detect(ctx context.Context) error {
+	pods, err := d.pods.List(labels.Everything())
+	if err != nil {
+		return err
+	}
+	iconfig := d.injector.Configs.Get()
+	drifted := make(map[corev1.ObjectReference]int)
+	replicaSetOwners := make(map[types.UID]*corev1.ObjectReference)
+	// pods of the cache must not be modified
+	for _, pod := range pods {
+		configHash, injected := pod.Annotations[logsidecarConfigHashAnnotationName]
+		if !injected || configHash == iconfig.Hash || pod.DeletionTimestamp != nil {
+			continue
+		}
+		drifted[d.workloadOf(ctx, pod, replicaSetOwners)]++
+	}
+
+	driftedPods := d.injector.Metrics.driftedPods
+	driftedPods.Reset()
+	for workload, n := range drifted {
+		driftedPods.WithLabelValues(workload.Namespace, workload.Kind, workload.Name).Set(float64(n))
+		if _, ok := d.drifted[workload]; !ok {
+			klog.Infof("%s %s/%s has %d pods with a stale logsidecar config", workload.Kind, workload.Namespace, workload.Name, n)
+			d.recorder.Eventf(&workload, corev1.EventTypeWarning, driftEventReason,
+				"%d pods run a logsidecar injected with a stale config, restart them to apply the current one", n)
+		}
+		if d.rolloutRestart {
+			if err := d.restart(ctx, workload, iconfig.Hash); err != nil {
+				klog.Errorf("failed to restart %s %s/%s: %v", workload.Kind, workload.Namespace, workload.Name, err)
+			}
+		}
+	}
+	d.drifted = drifted
+	return nil
+}
+
+// workloadOf returns the workload controlling pod, following a ReplicaSet to its
+// Deployment, or pod itself if it has no controller.
+func (d *DriftController) workloadOf(ctx context.Context, pod *corev1.Pod, replicaSetOwners map[types.UID]*corev1.ObjectReference) corev1.ObjectReference {
+	owner := metav1.GetControllerOf(pod)
+	if owner == nil {
+		return corev1.ObjectReference{APIVersion: "v1", Kind: "Pod", Namespace: pod.Namespace, Name: pod.Name, UID: pod.UID}
+	}
+	ref := corev1.ObjectReference{APIVersion: owner.APIVersion, Kind: owner.Kind, Namespace: pod.Namespace, Name: owner.Name, UID: owner.UID}
+	if owner.Kind != "ReplicaSet" {
+		return ref
+	}
+	deployment, ok := replicaSetOwners[owner.UID]
+	if !ok {
+		rs, err := d.client.AppsV1().ReplicaSets(pod.Namespace).Get(ctx, owner.Name, metav1.GetOptions{})
+		if err != nil {
+			klog.Warningf("failed to get owner of replicaset %s/%s: %v", pod.Namespace, owner.Name, err)
+		} else if o := metav1.GetControllerOf(rs); o != nil && o.Kind == "Deployment" {
+			deployment = &corev1.ObjectReference{APIVersion: o.APIVersion, Kind: o.Kind, Namespace: pod.Namespace, Name: o.Name, UID: o.UID}
+		}
+		replicaSetOwners[owner.UID] = deployment
+	}
+	if deployment != nil {
+		return *deployment
+	}
+	return ref
+}
+
+// restart triggers a rollout restart of a Deployment, StatefulSet or DaemonSet the
+// same way kubectl does, once per generation of the injector config.
+func (d *DriftController) restart(ctx context.Context, workload corev1.ObjectReference, configHash string) error {
+	var template *corev1.PodTemplateSpec
+	switch workload.Kind {
+	case "Deployment":
+		o, err := d.client.AppsV1().Deployments(workload.Namespace).Get(ctx, workload.Name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		template = &o.Spec.Template
+	case "StatefulSet":
+		o, err := d.client.AppsV1().StatefulSets(workload.Namespace).Get(ctx, workload.Name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		template = &o.Spec.Template
+	case "DaemonSet":
+		o, err := d.client.AppsV1().DaemonSets(workload.Namespace).Get(ctx, workload.Name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		template = &o.Spec.Template
+	default:
+		return nil
+	}
+	if template.Annotations[restartedForAnnotationName] == configHash {
+		// the rollout for the current config is in progress already
+		return nil
+	}
+
+	patch := []byte(fmt.Sprintf(`{"spec":{"template":{"metadata":{"annotations":{%q:%q,%q:%q}}}}}`,
+		restartedAtAnnotationName, d.injector.clock.Now().Format(time.RFC3339),
+		restartedForAnnotationName, configHash))
+	var err error
+	switch workload.Kind {
+	case "Deployment":
+		_, err = d.client.AppsV1().Deployments(workload.Namespace).Patch(ctx, workload.Name, types.StrategicMergePatchType, patch, metav1.PatchOptions{})
+	case "StatefulSet":
+		_, err = d.client.AppsV1().StatefulSets(workload.Namespace).Patch(ctx, workload.Name, types.StrategicMergePatchType, patch, metav1.PatchOptions{})
+	case "DaemonSet":
+		_, err = d.client.AppsV1().DaemonSets(workload.Namespace).Patch(ctx, workload.Name, types.StrategicMergePatchType, patch, metav1.PatchOptions{})
+	}
+	if err != nil {
+		return err
+	}
+	klog.Infof("restarted %s %s/%s to apply the current logsidecar config", workload.Kind, workload.Namespace, workload.Name)
+	d.injector.Metrics.driftRestarts.WithLabelValues(workload.Namespace, workload.Kind, workload.Name).Inc()
+	d.recorder.Eventf(&workload, corev1.EventTypeNormal, driftEventReason,
+		"restarted to apply the current logsidecar config")
+	return nil
+}
@@ -0,0 +1,100 @@
+package injector
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+)
+
+func TestDriftControllerDetect(t *testing.T) {
+	inj := newTestInjector(&InjectorConfig{Hash: "1"})
+	newPod := func(name string, owner *metav1.OwnerReference) *corev1.Pod {
+		pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{
+			Namespace: "default",
+			Name:      name,
+			Labels:    map[string]string{logsidecarInjectedLabelName: "true"},
+			Annotations: map[string]string{
+				logsidecarAnnotationName: `{"containerLogConfigs": {"app-container": {"datavolume": ["*.log"]}}}`,
+			},
+		}}
+		if owner != nil {
+			pod.OwnerReferences = []metav1.OwnerReference{*owner}
+		}
+		return pod
+	}
+	controller := true
+	deployment := &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web", UID: "web"}}
+	replicaSet := &appsv1.ReplicaSet{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web-1", UID: "web-1",
+		OwnerReferences: []metav1.OwnerReference{{APIVersion: "apps/v1", Kind: "Deployment", Name: "web", UID: "web", Controller: &controller}}}}
+	rsOwner := &metav1.OwnerReference{APIVersion: "apps/v1", Kind: "ReplicaSet", Name: "web-1", UID: "web-1", Controller: &controller}
+
+	upToDate := newPod("up-to-date", rsOwner)
+	upToDate.Annotations[logsidecarInjectedHashAnnotationName] = injectionHash(upToDate, inj.Configs.Get())
+	upToDate.Annotations[logsidecarConfigHashAnnotationName] = "1"
+	// containers changed by webhooks admitting the pod after the injector
+	mutatedLater := newPod("mutated-later", rsOwner)
+	mutatedLater.Spec.Containers = []corev1.Container{{Name: "app-container", Env: []corev1.EnvVar{{Name: "AWS_ROLE_ARN"}}}}
+	mutatedLater.Annotations[logsidecarInjectedHashAnnotationName] = "0"
+	mutatedLater.Annotations[logsidecarConfigHashAnnotationName] = "1"
+	drifted1 := newPod("drifted-1", rsOwner)
+	drifted1.Annotations[logsidecarInjectedHashAnnotationName] = "0"
+	drifted1.Annotations[logsidecarConfigHashAnnotationName] = "0"
+	drifted2 := newPod("drifted-2", rsOwner)
+	drifted2.Annotations[logsidecarInjectedHashAnnotationName] = "0"
+	drifted2.Annotations[logsidecarConfigHashAnnotationName] = "0"
+	standalone := newPod("standalone", nil)
+	standalone.Annotations[logsidecarInjectedHashAnnotationName] = "0"
+	standalone.Annotations[logsidecarConfigHashAnnotationName] = "0"
+	notInjected := newPod("not-injected", nil)
+	delete(notInjected.Labels, logsidecarInjectedLabelName)
+	// not watched without the label
+	unlabeled := newPod("unlabeled", nil)
+	unlabeled.Annotations[logsidecarInjectedHashAnnotationName] = "0"
+	unlabeled.Annotations[logsidecarConfigHashAnnotationName] = "0"
+	unlabeled.Labels = nil
+
+	client := fake.NewSimpleClientset([]runtime.Object{deployment, replicaSet,
+		upToDate, mutatedLater, drifted1, drifted2, standalone, notInjected, unlabeled}...)
+	recorder := record.NewFakeRecorder(10)
+	d := &DriftController{
+		injector:       inj,
+		client:         client,
+		recorder:       recorder,
+		rolloutRestart: true,
+		drifted:        make(map[corev1.ObjectReference]int),
+	}
+	stop := make(chan struct{})
+	defer close(stop)
+	if !d.startInformer(stop) {
+		t.Fatal("informer not synced")
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := d.Detect(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	driftedPods, driftRestarts := inj.Metrics.driftedPods, inj.Metrics.driftRestarts
+	assert.Equal(t, 2, testutil.CollectAndCount(driftedPods))
+	assert.Equal(t, float64(2), testutil.ToFloat64(driftedPods.WithLabelValues("default", "Deployment", "web")))
+	assert.Equal(t, float64(1), testutil.ToFloat64(driftedPods.WithLabelValues("default", "Pod", "standalone")))
+	assert.Equal(t, float64(1), testutil.ToFloat64(driftRestarts.WithLabelValues("default", "Deployment", "web")))
+
+	restarted, err := client.AppsV1().Deployments("default").Get(context.Background(), "web", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "1", restarted.Spec.Template.Annotations[restartedForAnnotationName])
+	assert.Equal(t, inj.clock.Now().Format(time.RFC3339), restarted.Spec.Template.Annotations[restartedAtAnnotationName])
+	// one drift event per workload and one restart event
+	assert.Len(t, recorder.Events, 3)
+}
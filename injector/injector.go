@@ -0,0 +1,57 @@
+package injector
+
+import (
+	"net/http"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/serializer"
+	"k8s.io/apimachinery/pkg/util/clock"
+)
+
+// Injector injects logsidecar into pods admitted to it with the config of its
+// ConfigStore. It serves the admission reviews of the webhook as an http.Handler.
+type Injector struct {
+	Configs *ConfigStore
+	Metrics *Metrics
+	// Audit records the admissions if not nil
+	Audit *AuditLog
+	// TracerProvider traces the admissions if not nil
+	TracerProvider trace.TracerProvider
+
+	clock  clock.Clock
+	scheme *runtime.Scheme
+	codecs serializer.CodecFactory
+}
+
+// NewInjector returns an Injector loading its config from the files of config. The
+// config has to be loaded by Configs.Reload before the Injector serves.
+func NewInjector(config *Config) *Injector {
+	return newInjector(config, clock.RealClock{})
+}
+
+func newInjector(config *Config, clock clock.Clock) *Injector {
+	metrics := NewMetrics()
+	scheme := newScheme()
+	return &Injector{
+		Configs: NewConfigStore(config, clock, metrics),
+		Metrics: metrics,
+		clock:   clock,
+		scheme:  scheme,
+		codecs:  serializer.NewCodecFactory(scheme),
+	}
+}
+
+func (i *Injector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if i.TracerProvider != nil {
+		ctx := tracePropagator.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := i.TracerProvider.Tracer(tracerName).Start(ctx, "admission",
+			trace.WithSpanKind(trace.SpanKindServer), trace.WithAttributes(attribute.String("http.method", r.Method)))
+		defer span.End()
+		r = r.WithContext(ctx)
+	}
+	serve(w, r, i.codecs.UniversalDeserializer(), i.MutateLogsidecarPods)
+}
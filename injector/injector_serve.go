@@ -1,18 +1,24 @@
 package injector
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"mime"
 	"net/http"
+	"runtime/debug"
+	"strings"
 
+	"go.opentelemetry.io/otel/attribute"
 	"k8s.io/api/admission/v1beta1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/klog"
 )
 
 // admitFunc is the type we use for all of our validators and mutators
-type admitFunc func(v1beta1.AdmissionReview) *v1beta1.AdmissionResponse
+type admitFunc func(context.Context, v1beta1.AdmissionReview) *v1beta1.AdmissionResponse
 
 // toAdmissionResponse is a helper function to create an AdmissionResponse
 // with an embedded error
@@ -24,27 +30,39 @@ func toAdmissionResponse(err error) *v1beta1.AdmissionResponse {
 	}
 }
 
+// maxAdmissionReviewBytes limits the size of admission reviews, which hold a pod and
+// its old version of at most 3MiB each as etcd limits objects.
+const maxAdmissionReviewBytes = 7 << 20
+
 // serve handles the http portion of a request prior to handing to an admit function
-func serve(w http.ResponseWriter, r *http.Request, admit admitFunc) {
-	var body []byte
-	if r.Body != nil {
-		if data, err := ioutil.ReadAll(r.Body); err == nil {
-			body = data
-		} else {
-			err = fmt.Errorf("fail to read request body: %v", err)
-			klog.Error(err)
-			return
-		}
+func serve(w http.ResponseWriter, r *http.Request, deserializer runtime.Decoder, admit admitFunc) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		httpError(w, fmt.Errorf("method %s not allowed", r.Method), http.StatusMethodNotAllowed)
+		return
 	}
 
 	// verify the content type is accurate
 	contentType := r.Header.Get("Content-Type")
-	if contentType != "application/json" {
-		err := fmt.Errorf("contentType=%s, expect application/json", contentType)
-		klog.Error(err)
+	if mediaType, _, err := mime.ParseMediaType(contentType); err != nil || mediaType != "application/json" {
+		httpError(w, fmt.Errorf("contentType=%s, expect application/json", contentType), http.StatusUnsupportedMediaType)
 		return
 	}
 
+	var body []byte
+	if r.Body != nil {
+		data, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxAdmissionReviewBytes))
+		if err != nil {
+			status := http.StatusBadRequest
+			if strings.Contains(err.Error(), "request body too large") {
+				status = http.StatusRequestEntityTooLarge
+			}
+			httpError(w, fmt.Errorf("fail to read request body: %v", err), status)
+			return
+		}
+		body = data
+	}
+
 	klog.V(2).Info(fmt.Sprintf("handling request: %s", body))
 
 	// The AdmissionReview that was sent to the webhook
@@ -53,16 +71,20 @@ func serve(w http.ResponseWriter, r *http.Request, admit admitFunc) {
 	// The AdmissionReview that will be returned
 	responseAdmissionReview := v1beta1.AdmissionReview{}
 
-	deserializer := codecs.UniversalDeserializer()
-	if _, _, err := deserializer.Decode(body, nil, &requestedAdmissionReview); err != nil {
-		err = fmt.Errorf("fail to decode admission request: %v", err)
-		klog.Error(err)
-		responseAdmissionReview.Response = toAdmissionResponse(err)
-	} else {
-		// pass to admitFunc
-		responseAdmissionReview.Response = admit(requestedAdmissionReview)
+	_, span := startSpan(r.Context(), "decode admission review", attribute.Int("http.request_content_length", len(body)))
+	_, _, err := deserializer.Decode(body, nil, &requestedAdmissionReview)
+	endSpan(span, err)
+	if err != nil {
+		httpError(w, fmt.Errorf("fail to decode admission request: %v", err), http.StatusBadRequest)
+		return
+	}
+	if requestedAdmissionReview.Request == nil {
+		httpError(w, fmt.Errorf("admission review has no request"), http.StatusBadRequest)
+		return
 	}
 
+	// pass to admitFunc
+	responseAdmissionReview.Response = safeAdmit(r.Context(), admit, requestedAdmissionReview)
 	// Return the same UID
 	responseAdmissionReview.Response.UID = requestedAdmissionReview.Request.UID
 
@@ -70,15 +92,35 @@ func serve(w http.ResponseWriter, r *http.Request, admit admitFunc) {
 
 	respBytes, err := json.Marshal(responseAdmissionReview)
 	if err != nil {
-		err = fmt.Errorf("fail to return json encoding of admission response: %v", contentType)
-		klog.Error(err)
+		httpError(w, fmt.Errorf("fail to return json encoding of admission response: %v", err), http.StatusInternalServerError)
+		return
 	}
+	w.Header().Set("Content-Type", "application/json")
 	if _, err = w.Write(respBytes); err != nil {
 		err = fmt.Errorf("fail to write the data to the connection: %v", err)
 		klog.Error(err)
 	}
 }
 
-func ServeLogSidecarPods(w http.ResponseWriter, r *http.Request) {
-	serve(w, r, MutateLogsidecarPods)
+// safeAdmit passes ar to admit, and turns a panic of admit into an error response,
+// so that one malformed object cannot take the webhook down.
+func safeAdmit(ctx context.Context, admit admitFunc, ar v1beta1.AdmissionReview) (resp *v1beta1.AdmissionResponse) {
+	defer func() {
+		if r := recover(); r != nil {
+			err := fmt.Errorf("internal error while admitting %s %s/%s: %v",
+				ar.Request.Kind.Kind, ar.Request.Namespace, ar.Request.Name, r)
+			klog.Errorf("%v\n%s", err, debug.Stack())
+			resp = toAdmissionResponse(err)
+		}
+	}()
+	resp = admit(ctx, ar)
+	if resp == nil {
+		resp = toAdmissionResponse(fmt.Errorf("no admission response"))
+	}
+	return resp
+}
+
+func httpError(w http.ResponseWriter, err error, status int) {
+	klog.Error(err)
+	http.Error(w, err.Error(), status)
 }
@@ -0,0 +1,20 @@
+//go:build go1.18
+// +build go1.18
+
+package injector
+
+import "testing"
+
+// FuzzServe feeds arbitrary bodies to the webhook, which must answer them with an
+// admission response or a client error, and never panic. TestServeMalformedBodies
+// checks the seeds on toolchains without fuzzing.
+func FuzzServe(f *testing.F) {
+	inj := newTestInjector(loadShippedInjectorConfig(f, SidecarTypeVector))
+	f.Add(admissionReviewBody(f))
+	for _, tt := range malformedBodies {
+		f.Add([]byte(tt.body))
+	}
+	f.Fuzz(func(t *testing.T, body []byte) {
+		checkServe(t, inj, body)
+	})
+}
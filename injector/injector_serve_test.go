@@ -0,0 +1,162 @@
+package injector
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/api/admission/v1beta1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+type errReader struct{}
+
+func (errReader) Read([]byte) (int, error) {
+	return 0, errors.New("connection reset")
+}
+
+func admissionReviewBody(t testing.TB) []byte {
+	ar := podAdmissionReview(t, v1beta1.Create, appPod(), nil)
+	ar.APIVersion, ar.Kind = "admission.k8s.io/v1beta1", "AdmissionReview"
+	ar.Request.UID = "uid"
+	body, err := json.Marshal(ar)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return body
+}
+
+func TestServe(t *testing.T) {
+	inj := newTestInjector(loadShippedInjectorConfig(t, SidecarTypeVector))
+	valid := admissionReviewBody(t)
+	tests := []struct {
+		name        string
+		method      string
+		contentType string
+		body        io.Reader
+		admit       admitFunc
+		status      int
+		// message is expected in the admission response if status is 200
+		message string
+	}{
+		{name: "admitted", body: bytes.NewReader(valid), status: http.StatusOK},
+		{name: "content type with charset", contentType: "application/json; charset=utf-8", body: bytes.NewReader(valid), status: http.StatusOK},
+		{name: "wrong method", method: http.MethodGet, body: bytes.NewReader(valid), status: http.StatusMethodNotAllowed},
+		{name: "wrong content type", contentType: "text/plain", body: bytes.NewReader(valid), status: http.StatusUnsupportedMediaType},
+		{name: "no content type", contentType: "-", body: bytes.NewReader(valid), status: http.StatusUnsupportedMediaType},
+		{name: "body too large", body: io.MultiReader(bytes.NewReader(valid), strings.NewReader(strings.Repeat(" ", maxAdmissionReviewBytes))), status: http.StatusRequestEntityTooLarge},
+		{name: "broken body", body: errReader{}, status: http.StatusBadRequest},
+		{name: "empty body", body: strings.NewReader(""), status: http.StatusBadRequest},
+		{name: "invalid json", body: strings.NewReader(`{"apiVersion":`), status: http.StatusBadRequest},
+		{name: "unknown kind", body: strings.NewReader(`{"apiVersion":"v1","kind":"Pod"}`), status: http.StatusBadRequest},
+		{name: "no request", body: strings.NewReader(`{"apiVersion":"admission.k8s.io/v1beta1","kind":"AdmissionReview"}`), status: http.StatusBadRequest},
+		{name: "no object", body: strings.NewReader(`{"apiVersion":"admission.k8s.io/v1beta1","kind":"AdmissionReview","request":{"uid":"uid","resource":{"version":"v1","resource":"pods"},"operation":"CREATE"}}`),
+			status: http.StatusOK, message: "fail to decode admission request"},
+		{name: "panic", body: bytes.NewReader(valid), admit: func(context.Context, v1beta1.AdmissionReview) *v1beta1.AdmissionResponse { panic("boom") },
+			status: http.StatusOK, message: "internal error while admitting"},
+		{name: "no response", body: bytes.NewReader(valid), admit: func(context.Context, v1beta1.AdmissionReview) *v1beta1.AdmissionResponse { return nil },
+			status: http.StatusOK, message: "no admission response"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			method := tt.method
+			if method == "" {
+				method = http.MethodPost
+			}
+			r := httptest.NewRequest(method, "/", tt.body)
+			switch tt.contentType {
+			case "":
+				r.Header.Set("Content-Type", "application/json")
+			case "-":
+			default:
+				r.Header.Set("Content-Type", tt.contentType)
+			}
+			admit := tt.admit
+			if admit == nil {
+				admit = inj.MutateLogsidecarPods
+			}
+			w := httptest.NewRecorder()
+			serve(w, r, inj.codecs.UniversalDeserializer(), admit)
+
+			assert.Equal(t, tt.status, w.Code, w.Body.String())
+			if w.Code != http.StatusOK {
+				assert.NotEmpty(t, w.Body.String())
+				return
+			}
+			assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+			var review v1beta1.AdmissionReview
+			if err := json.Unmarshal(w.Body.Bytes(), &review); err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, types.UID("uid"), review.Response.UID)
+			if tt.message == "" {
+				assert.True(t, review.Response.Allowed)
+				assert.NotEmpty(t, review.Response.Patch)
+			} else {
+				assert.False(t, review.Response.Allowed)
+				assert.Contains(t, review.Response.Result.Message, tt.message)
+			}
+		})
+	}
+}
+
+// malformedBodies are bodies the webhook has to answer with an admission response or a
+// client error without panicking. They seed FuzzServe as well.
+var malformedBodies = []struct {
+	name string
+	body string
+}{
+	{"no request", `{"apiVersion":"admission.k8s.io/v1beta1","kind":"AdmissionReview"}`},
+	{"log path above the volume root", `{"apiVersion":"admission.k8s.io/v1beta1","kind":"AdmissionReview","request":{"resource":{"version":"v1","resource":"pods"},"operation":"CREATE","object":{"metadata":{"annotations":{"logging.kubesphere.io/logsidecar-config":"{\"containerLogConfigs\":{\"c\":{\"v:/\":[\"../*.log\"]}}}"}},"spec":{"containers":[{"name":"c","volumeMounts":[{"name":"v","mountPath":"/"}]}]}}}}`},
+	{"update of an empty pod", `{"apiVersion":"admission.k8s.io/v1beta1","kind":"AdmissionReview","request":{"resource":{"version":"v1","resource":"pods"},"operation":"UPDATE","object":{},"oldObject":{"metadata":{"annotations":{"logging.kubesphere.io/logsidecar-injected-hash":""}}}}}`},
+	{"null", `null`},
+	{"array", `[]`},
+	{"string", `"AdmissionReview"`},
+	{"null request", `{"apiVersion":"admission.k8s.io/v1beta1","kind":"AdmissionReview","request":null}`},
+	{"object not a pod", `{"apiVersion":"admission.k8s.io/v1beta1","kind":"AdmissionReview","request":{"resource":{"version":"v1","resource":"pods"},"operation":"CREATE","object":[1,2]}}`},
+	{"null containers", `{"apiVersion":"admission.k8s.io/v1beta1","kind":"AdmissionReview","request":{"resource":{"version":"v1","resource":"pods"},"operation":"CREATE","object":{"metadata":{"annotations":{"logging.kubesphere.io/logsidecar-config":"{\"containerLogConfigs\":{\"c\":{\"v\":[\"*.log\"]}}}"}},"spec":{"containers":null}}}}`},
+	{"invalid log config", `{"apiVersion":"admission.k8s.io/v1beta1","kind":"AdmissionReview","request":{"resource":{"version":"v1","resource":"pods"},"operation":"CREATE","object":{"metadata":{"annotations":{"logging.kubesphere.io/logsidecar-config":"{\"containerLogConfigs\":["}}}}}`},
+	{"null log paths", `{"apiVersion":"admission.k8s.io/v1beta1","kind":"AdmissionReview","request":{"resource":{"version":"v1","resource":"pods"},"operation":"CREATE","object":{"metadata":{"annotations":{"logging.kubesphere.io/logsidecar-config":"{\"containerLogConfigs\":{\"c\":{\"v\":null}}}"}},"spec":{"containers":[{"name":"c","volumeMounts":[{"name":"v","mountPath":"/data"}]}]}}}}`},
+	{"unknown operation", `{"apiVersion":"admission.k8s.io/v1beta1","kind":"AdmissionReview","request":{"resource":{"version":"v1","resource":"pods"},"operation":"CONNECT","object":{}}}`},
+	{"other resource", `{"apiVersion":"admission.k8s.io/v1beta1","kind":"AdmissionReview","request":{"resource":{"version":"v1","resource":"services"},"operation":"CREATE","object":{}}}`},
+	{"invalid old object", `{"apiVersion":"admission.k8s.io/v1beta1","kind":"AdmissionReview","request":{"resource":{"version":"v1","resource":"pods"},"operation":"UPDATE","object":{},"oldObject":"pod"}}`},
+}
+
+// checkServe serves body by inj, and fails t unless it is answered with an admission
+// response or a client error.
+func checkServe(t testing.TB, inj *Injector, body []byte) {
+	t.Helper()
+	r := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	inj.ServeHTTP(w, r)
+	switch w.Code {
+	case http.StatusOK:
+		var review v1beta1.AdmissionReview
+		if err := json.Unmarshal(w.Body.Bytes(), &review); err != nil || review.Response == nil {
+			t.Fatalf("invalid admission review %s: %v", w.Body.String(), err)
+		}
+		if review.Response.Result != nil && strings.Contains(review.Response.Result.Message, "internal error") {
+			t.Fatalf("admission panicked: %s", review.Response.Result.Message)
+		}
+	case http.StatusBadRequest:
+	default:
+		t.Fatalf("unexpected status %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestServeMalformedBodies(t *testing.T) {
+	inj := newTestInjector(loadShippedInjectorConfig(t, SidecarTypeVector))
+	for _, tt := range malformedBodies {
+		t.Run(tt.name, func(t *testing.T) {
+			checkServe(t, inj, []byte(tt.body))
+		})
+	}
+}
@@ -0,0 +1,43 @@
+package injector
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/api/admission/v1beta1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func TestInjectorServeHTTP(t *testing.T) {
+	for _, sidecarType := range []string{SidecarTypeVector, SidecarTypeFilebeat} {
+		sidecarType := sidecarType
+		t.Run(sidecarType, func(t *testing.T) {
+			t.Parallel()
+			server := httptest.NewServer(newTestInjector(loadShippedInjectorConfig(t, sidecarType)))
+			defer server.Close()
+
+			ar := podAdmissionReview(t, v1beta1.Create, appPod(), nil)
+			ar.Request.UID = types.UID(sidecarType)
+			body, err := json.Marshal(ar)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, err := http.Post(server.URL, "application/json", bytes.NewReader(body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			var review v1beta1.AdmissionReview
+			if err = json.NewDecoder(resp.Body).Decode(&review); err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, ar.Request.UID, review.Response.UID)
+			assert.True(t, review.Response.Allowed)
+			assert.Contains(t, string(review.Response.Patch), "/etc/logsidecar/"+sidecarType+".yaml")
+		})
+	}
+}
@@ -0,0 +1,70 @@
+package injector
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/uuid"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+	"k8s.io/klog"
+)
+
+const serviceAccountNamespaceFile = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
+
+// RunLeaderElected runs run while this replica holds the lease of the leader election,
+// with a context cancelled when the lease is lost, and runs for the lease again until ctx
+// is done. Without leader election, it runs run with ctx right away.
+func (c *Config) RunLeaderElected(ctx context.Context, client kubernetes.Interface, run func(ctx context.Context)) error {
+	if !c.LeaderElection {
+		run(ctx)
+		return nil
+	}
+	namespace := c.LeaderElectionNamespace
+	if namespace == "" {
+		data, err := ioutil.ReadFile(serviceAccountNamespaceFile)
+		if err != nil {
+			return fmt.Errorf("leader election requires --leader-election-namespace out of cluster: %v", err)
+		}
+		namespace = strings.TrimSpace(string(data))
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		return err
+	}
+	// the hostname is unique per pod, the uuid per process
+	id := hostname + "_" + string(uuid.NewUUID())
+	elector, err := leaderelection.NewLeaderElector(leaderelection.LeaderElectionConfig{
+		Lock: &resourcelock.LeaseLock{
+			LeaseMeta:  metav1.ObjectMeta{Namespace: namespace, Name: c.LeaderElectionLeaseName},
+			Client:     client.CoordinationV1(),
+			LockConfig: resourcelock.ResourceLockConfig{Identity: id},
+		},
+		LeaseDuration:   15 * time.Second,
+		RenewDeadline:   10 * time.Second,
+		RetryPeriod:     2 * time.Second,
+		ReleaseOnCancel: true,
+		Name:            c.LeaderElectionLeaseName,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: run,
+			OnStoppedLeading: func() {
+				klog.Infof("%s stopped leading", id)
+			},
+			OnNewLeader: func(identity string) {
+				klog.Infof("%s is the leader", identity)
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	wait.UntilWithContext(ctx, elector.Run, time.Second)
+	return nil
+}
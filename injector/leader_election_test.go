@@ -0,0 +1,48 @@
+package injector
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestRunLeaderElected(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	config := &Config{LeaderElection: true, LeaderElectionNamespace: "kube-system", LeaderElectionLeaseName: "logsidecar-injector"}
+	ctx, cancel := context.WithCancel(context.Background())
+	var running int32
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := config.RunLeaderElected(ctx, client, func(ctx context.Context) {
+				atomic.AddInt32(&running, 1)
+				<-ctx.Done()
+			})
+			assert.NoError(t, err)
+		}()
+	}
+	for atomic.LoadInt32(&running) == 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	// the others keep waiting for the lease
+	time.Sleep(3 * time.Second)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&running))
+	cancel()
+	wg.Wait()
+}
+
+func TestRunWithoutLeaderElection(t *testing.T) {
+	ran := false
+	err := (&Config{}).RunLeaderElected(context.Background(), nil, func(ctx context.Context) {
+		ran = true
+	})
+	assert.NoError(t, err)
+	assert.True(t, ran)
+}
@@ -2,29 +2,190 @@ package injector
 
 import (
 	"encoding/json"
+	"fmt"
 	"strings"
 	"sync"
-)
+	"sync/atomic"
+	"time"
 
-var (
-	injectorConfig *InjectorConfig
-	mutex          sync.Mutex
+	"k8s.io/apimachinery/pkg/util/clock"
 )
 
-func ReloadInjectorConfig(c *Config) error {
-	mutex.Lock()
-	defer mutex.Unlock()
-	ic, err := c.InjectorConfig()
+// maxConfigHistory is the number of configs kept for rollback and of reload attempts
+// kept for inspection.
+const maxConfigHistory = 10
+
+// ConfigStore loads the injector config from the files of its Config, and keeps the
+// active config along with the last ones loaded.
+type ConfigStore struct {
+	config  *Config
+	clock   clock.Clock
+	metrics *Metrics
+
+	// active holds the active *InjectorConfig. It is swapped atomically, so admissions
+	// never wait for a reload.
+	active atomic.Value
+	// mutex serializes the reloads and the updates of the active config and the history
+	mutex sync.Mutex
+	// history are the last loaded configs, ending with the active one
+	history        []*InjectorConfig
+	attempts       []ReloadAttempt
+	lastGeneration int64
+}
+
+func NewConfigStore(config *Config, clock clock.Clock, metrics *Metrics) *ConfigStore {
+	return &ConfigStore{config: config, clock: clock, metrics: metrics}
+}
+
+// ReloadAttempt records a reload or rollback of the config.
+type ReloadAttempt struct {
+	Time   time.Time `json:"time"`
+	Action string    `json:"action"`
+	// Generation and Hash are those of the config activated, if any
+	Generation int64  `json:"generation,omitempty"`
+	Hash       string `json:"hash,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+// ConfigVersion is a loaded config as shown by InjectorConfigStatus.
+type ConfigVersion struct {
+	Generation  int64     `json:"generation"`
+	Hash        string    `json:"hash"`
+	LoadTime    time.Time `json:"loadTime"`
+	SidecarType string    `json:"sidecarType"`
+	// SidecarConfig, Sidecar and Template may hold credentials, e.g. in the env of the
+	// sidecar, so they are only shown if the contents are requested
+	SidecarConfig *SidecarConfig `json:"sidecarConfig,omitempty"`
+	// Sidecar and Template are the contents of the sidecar config and template files,
+	// only shown for the active config
+	Sidecar  string `json:"sidecar,omitempty"`
+	Template string `json:"template,omitempty"`
+}
+
+// ConfigStatus is the active config along with the configs available to rollback and
+// the last reload attempts.
+type ConfigStatus struct {
+	Active   *ConfigVersion  `json:"active"`
+	History  []ConfigVersion `json:"history"`
+	Attempts []ReloadAttempt `json:"attempts"`
+}
+
+func configVersion(ic *InjectorConfig, contents bool) ConfigVersion {
+	version := ConfigVersion{
+		Generation:  ic.Generation,
+		Hash:        ic.Hash,
+		LoadTime:    ic.LoadTime,
+		SidecarType: ic.SidecarType,
+	}
+	if contents {
+		sidecarConfig := ic.SidecarConfig
+		version.SidecarConfig = &sidecarConfig
+		version.Sidecar = string(ic.sidecarContent)
+		version.Template = string(ic.templateContent)
+	}
+	return version
+}
+
+func (s *ConfigStore) recordAttempt(attempt ReloadAttempt) {
+	s.attempts = append(s.attempts, attempt)
+	if len(s.attempts) > maxConfigHistory {
+		s.attempts = s.attempts[len(s.attempts)-maxConfigHistory:]
+	}
+}
+
+// Reload loads the config as a new generation. The active config is
+// kept if loading fails.
+func (s *ConfigStore) Reload() error {
+	// load under the lock, so that concurrent reloads number the configs in the order
+	// the files were read and the latest one read stays active
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	start := s.clock.Now()
+	ic, err := s.config.InjectorConfig()
+	attempt := ReloadAttempt{Time: start, Action: "reload"}
 	if err != nil {
+		attempt.Error = err.Error()
+		s.recordAttempt(attempt)
+		s.metrics.configReloads.WithLabelValues("failure").Inc()
+		s.metrics.configLastReloadSuccessful.Set(0)
 		return err
 	}
-	injectorConfig = ic
+	s.lastGeneration++
+	ic.Generation = s.lastGeneration
+	ic.LoadTime = attempt.Time
+	attempt.Generation, attempt.Hash = ic.Generation, ic.Hash
+	s.recordAttempt(attempt)
+
+	s.activate(ic)
+	s.history = append(s.history, ic)
+	if len(s.history) > maxConfigHistory {
+		s.history = s.history[len(s.history)-maxConfigHistory:]
+	}
+	s.metrics.configReloads.WithLabelValues("success").Inc()
+	s.metrics.configLastReloadSuccessful.Set(1)
 	return nil
 }
-func GetInjectorConfig() *InjectorConfig {
-	mutex.Lock()
-	defer mutex.Unlock()
-	return injectorConfig
+
+// Rollback activates the config of the generation before the active one,
+// and drops the active one from the history.
+func (s *ConfigStore) Rollback() (*InjectorConfig, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	attempt := ReloadAttempt{Time: s.clock.Now(), Action: "rollback"}
+	if len(s.history) < 2 {
+		err := fmt.Errorf("no previous config to rollback to")
+		attempt.Error = err.Error()
+		s.recordAttempt(attempt)
+		s.metrics.configRollbacks.WithLabelValues("failure").Inc()
+		return nil, err
+	}
+	s.history = s.history[:len(s.history)-1]
+	ic := s.history[len(s.history)-1]
+	s.activate(ic)
+	attempt.Generation, attempt.Hash = ic.Generation, ic.Hash
+	s.recordAttempt(attempt)
+	s.metrics.configRollbacks.WithLabelValues("success").Inc()
+	return ic, nil
+}
+
+// Status returns the active config, the history and the reload attempts,
+// the latest last. The contents of the configs are left out unless contents is set.
+func (s *ConfigStore) Status(contents bool) ConfigStatus {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	status := ConfigStatus{
+		History:  make([]ConfigVersion, 0, len(s.history)),
+		Attempts: append([]ReloadAttempt{}, s.attempts...),
+	}
+	if ic := s.Get(); ic != nil {
+		active := configVersion(ic, contents)
+		status.Active = &active
+	}
+	for _, ic := range s.history {
+		version := configVersion(ic, contents)
+		version.Sidecar, version.Template = "", ""
+		status.History = append(status.History, version)
+	}
+	return status
+}
+
+// activate sets ic active, and exposes its generation and hash as metrics.
+func (s *ConfigStore) activate(ic *InjectorConfig) {
+	s.set(ic)
+	s.metrics.configGeneration.Set(float64(ic.Generation))
+	s.metrics.configInfo.Reset()
+	s.metrics.configInfo.WithLabelValues(ic.Hash).Set(1)
+}
+
+func (s *ConfigStore) set(ic *InjectorConfig) {
+	s.active.Store(ic)
+}
+
+// Get returns the active config without locking. The config returned must not be
+// modified.
+func (s *ConfigStore) Get() *InjectorConfig {
+	ic, _ := s.active.Load().(*InjectorConfig)
+	return ic
 }
 
 type ContainerLogConfig struct {
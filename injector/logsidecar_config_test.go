@@ -0,0 +1,103 @@
+package injector
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"k8s.io/api/admission/v1beta1"
+)
+
+// reloadContinuously reloads the config until stop is closed, and returns the number
+// of reloads done.
+func reloadContinuously(tb testing.TB, inj *Injector, stop <-chan struct{}) func() int64 {
+	var reloads int64
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			if err := inj.Configs.Reload(); err != nil {
+				tb.Error(err)
+				return
+			}
+			atomic.AddInt64(&reloads, 1)
+		}
+	}()
+	return func() int64 {
+		wg.Wait()
+		return atomic.LoadInt64(&reloads)
+	}
+}
+
+func TestMutateLogsidecarPodsDuringReload(t *testing.T) {
+	inj := NewInjector(shippedConfig(t, SidecarTypeVector))
+	if err := inj.Configs.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	ar := podAdmissionReview(t, v1beta1.Create, appPod(), nil)
+
+	stop := make(chan struct{})
+	reloads := reloadContinuously(t, inj, stop)
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				if resp := inj.MutateLogsidecarPods(context.Background(), ar); !resp.Allowed || resp.Patch == nil {
+					t.Errorf("unexpected response %v", resp)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(stop)
+	reloads()
+}
+
+// BenchmarkMutateLogsidecarPods measures the admission throughput of concurrent
+// admissions, with and without reloads of the config happening meanwhile.
+func BenchmarkMutateLogsidecarPods(b *testing.B) {
+	for _, reloading := range []bool{false, true} {
+		name := "idle"
+		if reloading {
+			name = "reloading"
+		}
+		b.Run(name, func(b *testing.B) {
+			inj := NewInjector(shippedConfig(b, SidecarTypeVector))
+			if err := inj.Configs.Reload(); err != nil {
+				b.Fatal(err)
+			}
+			ar := podAdmissionReview(b, v1beta1.Create, appPod(), nil)
+
+			stop := make(chan struct{})
+			reloads := func() int64 { return 0 }
+			if reloading {
+				reloads = reloadContinuously(b, inj, stop)
+			}
+			start := time.Now()
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					if resp := inj.MutateLogsidecarPods(context.Background(), ar); !resp.Allowed {
+						b.Errorf("unexpected response %v", resp)
+					}
+				}
+			})
+			b.StopTimer()
+			elapsed := time.Since(start)
+			close(stop)
+			b.ReportMetric(float64(b.N)/elapsed.Seconds(), "admissions/s")
+			b.ReportMetric(float64(reloads())/elapsed.Seconds(), "reloads/s")
+		})
+	}
+}
@@ -0,0 +1,141 @@
+package injector
+
+import (
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+)
+
+// patchOperation is an operation of a json patch, see RFC 6902.
+type patchOperation struct {
+	Op    string      `json:"op"`
+	Path  string      `json:"path"`
+	Value interface{} `json:"value,omitempty"`
+}
+
+// podPatch builds the json patch of the injection into a pod from the parts of the
+// pod the injector changes, i.e. the labels, annotations, init containers, containers
+// and volumes, instead of diffing the whole pod. It holds these parts as they were
+// before the injection.
+type podPatch struct {
+	labels         map[string]string
+	annotations    map[string]string
+	initContainers []corev1.Container
+	containers     []corev1.Container
+	volumes        []corev1.Volume
+}
+
+// newPodPatch captures the parts of pod the injector changes. pod may be changed
+// afterwards, as removing the logsidecar does in place.
+func newPodPatch(pod *corev1.Pod) *podPatch {
+	return &podPatch{
+		labels:         copyStringMap(pod.Labels),
+		annotations:    copyStringMap(pod.Annotations),
+		initContainers: append([]corev1.Container(nil), pod.Spec.InitContainers...),
+		containers:     append([]corev1.Container(nil), pod.Spec.Containers...),
+		volumes:        append([]corev1.Volume(nil), pod.Spec.Volumes...),
+	}
+}
+
+func copyStringMap(m map[string]string) map[string]string {
+	if m == nil {
+		return nil
+	}
+	c := make(map[string]string, len(m))
+	for k, v := range m {
+		c[k] = v
+	}
+	return c
+}
+
+// operations returns the operations taking the captured pod to pod. Entries of the
+// lists are removed and appended, as the injector never changes one in place.
+func (p *podPatch) operations(pod *corev1.Pod) []patchOperation {
+	var ops []patchOperation
+	ops = appendMapOperations(ops, "/metadata/annotations", p.annotations, pod.Annotations)
+	ops = appendMapOperations(ops, "/metadata/labels", p.labels, pod.Labels)
+	ops = appendListOperations(ops, "/spec/initContainers", p.initContainers, pod.Spec.InitContainers)
+	ops = appendListOperations(ops, "/spec/containers", p.containers, pod.Spec.Containers)
+	ops = appendListOperations(ops, "/spec/volumes", p.volumes, pod.Spec.Volumes)
+	return ops
+}
+
+func appendMapOperations(ops []patchOperation, path string, old, new map[string]string) []patchOperation {
+	if len(old) == 0 {
+		if len(new) > 0 {
+			ops = append(ops, patchOperation{Op: "add", Path: path, Value: new})
+		}
+		return ops
+	}
+	if len(new) == 0 {
+		return append(ops, patchOperation{Op: "remove", Path: path})
+	}
+	keys := make([]string, 0, len(old)+len(new))
+	for k := range old {
+		keys = append(keys, k)
+	}
+	for k := range new {
+		if _, ok := old[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		oldValue, inOld := old[k]
+		newValue, inNew := new[k]
+		keyPath := path + "/" + escapePointerToken(k)
+		switch {
+		case !inNew:
+			ops = append(ops, patchOperation{Op: "remove", Path: keyPath})
+		case !inOld:
+			ops = append(ops, patchOperation{Op: "add", Path: keyPath, Value: newValue})
+		case oldValue != newValue:
+			ops = append(ops, patchOperation{Op: "replace", Path: keyPath, Value: newValue})
+		}
+	}
+	return ops
+}
+
+// appendListOperations appends the operations taking the slice old to the slice new,
+// which has to be old with entries removed and entries appended. Entries of old are
+// kept in order as long as they match the next ones of new, and removed otherwise,
+// from the last one so that the indices stay valid. The rest of new is appended.
+func appendListOperations(ops []patchOperation, path string, old, new interface{}) []patchOperation {
+	oldList, newList := reflect.ValueOf(old), reflect.ValueOf(new)
+	if oldList.Len() == 0 {
+		if newList.Len() > 0 {
+			ops = append(ops, patchOperation{Op: "add", Path: path, Value: new})
+		}
+		return ops
+	}
+	if newList.Len() == 0 {
+		return append(ops, patchOperation{Op: "remove", Path: path})
+	}
+	var removed []int
+	j := 0
+	for i := 0; i < oldList.Len(); i++ {
+		if j < newList.Len() && equality.Semantic.DeepEqual(oldList.Index(i).Interface(), newList.Index(j).Interface()) {
+			j++
+			continue
+		}
+		removed = append(removed, i)
+	}
+	for k := len(removed) - 1; k >= 0; k-- {
+		ops = append(ops, patchOperation{Op: "remove", Path: path + "/" + strconv.Itoa(removed[k])})
+	}
+	for ; j < newList.Len(); j++ {
+		ops = append(ops, patchOperation{Op: "add", Path: path + "/-", Value: newList.Index(j).Interface()})
+	}
+	return ops
+}
+
+var pointerTokenEscaper = strings.NewReplacer("~", "~0", "/", "~1")
+
+// escapePointerToken escapes s to be a reference token of a json pointer, see RFC 6901.
+func escapePointerToken(s string) string {
+	return pointerTokenEscaper.Replace(s)
+}
@@ -0,0 +1,244 @@
+package injector
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+
+	jsonpatch "github.com/evanphx/json-patch"
+	diffpatch "github.com/mattbaird/jsonpatch"
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/yaml"
+)
+
+// diffLogsidecarPatch creates the patch by diffing the whole pod, as the injector did
+// before building the patch directly. It is the reference of the patch builder.
+func diffLogsidecarPatch(raw []byte, pod *corev1.Pod) ([]byte, error) {
+	mu, err := json.Marshal(pod)
+	if err != nil {
+		return nil, err
+	}
+	patch, err := diffpatch.CreatePatch(raw, mu)
+	if err != nil {
+		return nil, err
+	}
+	if len(patch) > 0 {
+		sortDiffPatch(patch)
+		return json.Marshal(patch)
+	}
+	return nil, nil
+}
+
+// sortDiffPatch orders the operations of patch by path so that identical inputs give
+// identical patches. CreatePatch emits the operations of object keys in map order,
+// but the operations on elements of one array in an order that must be kept.
+func sortDiffPatch(patch []diffpatch.JsonPatchOperation) {
+	sort.SliceStable(patch, func(i, j int) bool {
+		pi, pj := strings.Split(patch[i].Path, "/"), strings.Split(patch[j].Path, "/")
+		for k := 0; k < len(pi) && k < len(pj); k++ {
+			if pi[k] == pj[k] {
+				continue
+			}
+			if isArrayIndex(pi[k]) && isArrayIndex(pj[k]) {
+				return false
+			}
+			return pi[k] < pj[k]
+		}
+		return len(pi) < len(pj)
+	})
+}
+
+func isArrayIndex(s string) bool {
+	if s == "-" {
+		return true
+	}
+	_, err := strconv.ParseUint(s, 10, 0)
+	return err == nil
+}
+
+// injectForPatch injects logsidecar into pod the way mutateLogsidecarPodCreate does, and
+// returns the pod as it was before, captured and serialized.
+func injectForPatch(t testing.TB, iconfig *InjectorConfig, pod *corev1.Pod) (*podPatch, []byte) {
+	raw, err := json.Marshal(pod)
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := newPodPatch(pod)
+	removeLogsidecarPart(pod)
+	delete(pod.Annotations, logsidecarInjectedHashAnnotationName)
+	delete(pod.Annotations, logsidecarStatusAnnotationName)
+	lscConfig, err := decodeLogsidecarConfig(pod.Annotations[logsidecarAnnotationName])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lscConfig != nil {
+		if _, err = addLogsidecarPart(context.Background(), iconfig, pod, lscConfig); err != nil {
+			t.Fatal(err)
+		}
+		pod.Annotations[logsidecarInjectedHashAnnotationName] = injectionHash(pod, iconfig)
+		pod.Annotations[logsidecarStatusAnnotationName] = logsidecarStatusInjected
+	}
+	return base, raw
+}
+
+func applyPatch(t testing.TB, raw, patch []byte) *corev1.Pod {
+	if len(patch) > 0 {
+		p, err := jsonpatch.DecodePatch(patch)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if raw, err = p.Apply(raw); err != nil {
+			t.Fatalf("%v: %s", err, patch)
+		}
+	}
+	pod := &corev1.Pod{}
+	if err := json.Unmarshal(raw, pod); err != nil {
+		t.Fatal(err)
+	}
+	return pod
+}
+
+func goldenPods(t testing.TB) map[string]*corev1.Pod {
+	podFiles, err := filepath.Glob(filepath.Join("testdata", "golden", "*.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pods := make(map[string]*corev1.Pod)
+	for _, podFile := range podFiles {
+		content, err := ioutil.ReadFile(podFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pod := &corev1.Pod{}
+		if err = yaml.Unmarshal(content, pod); err != nil {
+			t.Fatal(err)
+		}
+		pods[strings.TrimSuffix(filepath.Base(podFile), ".yaml")] = pod
+	}
+	return pods
+}
+
+// injectedPod returns pod injected by iconfig, with an app container and a volume added
+// after the logsidecar as other webhooks may do.
+func injectedPod(t testing.TB, iconfig *InjectorConfig, pod *corev1.Pod) *corev1.Pod {
+	pod = pod.DeepCopy()
+	injectForPatch(t, iconfig, pod)
+	pod.Spec.Containers = append(pod.Spec.Containers, corev1.Container{Name: "mesh-proxy"})
+	pod.Spec.Volumes = append(pod.Spec.Volumes, corev1.Volume{Name: "mesh-certs"})
+	return pod
+}
+
+func TestPodPatchEquivalence(t *testing.T) {
+	iconfig := loadShippedInjectorConfig(t, SidecarTypeVector)
+	reinjected := loadShippedInjectorConfig(t, SidecarTypeFilebeat)
+	pods := goldenPods(t)
+
+	bare := appPod()
+	bare.Spec.Volumes = nil
+	bare.Spec.Containers[0].VolumeMounts = []corev1.VolumeMount{{Name: "datavolume", MountPath: "/data"}}
+	pods["no-volumes"] = bare
+	for name, pod := range goldenPods(t) {
+		if pod.Annotations[logsidecarAnnotationName] != "" {
+			pods[name+"-reinjected"] = injectedPod(t, reinjected, pod)
+		}
+	}
+
+	for name, pod := range pods {
+		t.Run(name, func(t *testing.T) {
+			mutated := pod.DeepCopy()
+			base, raw := injectForPatch(t, iconfig, mutated)
+
+			built, err := createLogsidecarPatch(context.Background(), base, mutated)
+			if err != nil {
+				t.Fatal(err)
+			}
+			diffed, err := diffLogsidecarPatch(raw, mutated)
+			if err != nil {
+				t.Fatal(err)
+			}
+			builtPod, diffedPod := applyPatch(t, raw, built), applyPatch(t, raw, diffed)
+			if !equality.Semantic.DeepEqual(builtPod, diffedPod) {
+				t.Errorf("patches differ:\n%s\n%s", built, diffed)
+			}
+			assert.True(t, equality.Semantic.DeepEqual(mutated, builtPod))
+		})
+	}
+}
+
+func TestPodPatchOperations(t *testing.T) {
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{"a/b": "1", "c": "2"}},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{{Name: "a"}, {Name: logsidecarContainerName}, {Name: "b"}},
+			Volumes:    []corev1.Volume{{Name: "v"}},
+		},
+	}
+	base := newPodPatch(pod)
+	pod.Annotations = map[string]string{"c": "3", "d": "4"}
+	pod.Labels = map[string]string{logsidecarInjectedLabelName: "true"}
+	pod.Spec.Containers = []corev1.Container{{Name: "a"}, {Name: "b"}, {Name: logsidecarContainerName, Image: "new"}}
+	pod.Spec.InitContainers = []corev1.Container{{Name: logsidecarInitContainerName}}
+	pod.Spec.Volumes = nil
+
+	assert.Equal(t, []patchOperation{
+		{Op: "remove", Path: "/metadata/annotations/a~1b"},
+		{Op: "replace", Path: "/metadata/annotations/c", Value: "3"},
+		{Op: "add", Path: "/metadata/annotations/d", Value: "4"},
+		{Op: "add", Path: "/metadata/labels", Value: pod.Labels},
+		{Op: "add", Path: "/spec/initContainers", Value: pod.Spec.InitContainers},
+		{Op: "remove", Path: "/spec/containers/1"},
+		{Op: "add", Path: "/spec/containers/-", Value: pod.Spec.Containers[2]},
+		{Op: "remove", Path: "/spec/volumes"},
+	}, base.operations(pod))
+	assert.Empty(t, newPodPatch(pod).operations(pod))
+}
+
+// bigPod returns a pod of many containers with many env vars and volumes, of which one
+// container has its logs collected.
+func bigPod() *corev1.Pod {
+	pod := appPod()
+	for i := 0; i < 30; i++ {
+		c := corev1.Container{Name: fmt.Sprintf("container-%d", i), Image: "app:latest"}
+		for j := 0; j < 50; j++ {
+			c.Env = append(c.Env, corev1.EnvVar{Name: fmt.Sprintf("ENV_%d", j), Value: strings.Repeat("x", 100)})
+		}
+		volume := fmt.Sprintf("volume-%d", i)
+		pod.Spec.Volumes = append(pod.Spec.Volumes, corev1.Volume{Name: volume})
+		c.VolumeMounts = append(c.VolumeMounts, corev1.VolumeMount{Name: volume, MountPath: "/" + volume})
+		pod.Spec.Containers = append(pod.Spec.Containers, c)
+	}
+	return pod
+}
+
+func BenchmarkCreateLogsidecarPatch(b *testing.B) {
+	iconfig := loadShippedInjectorConfig(b, SidecarTypeVector)
+	for name, newPod := range map[string]func() *corev1.Pod{"small": appPod, "big": bigPod} {
+		mutated := newPod()
+		base, raw := injectForPatch(b, iconfig, mutated)
+		b.Run(name+"/builder", func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := createLogsidecarPatch(context.Background(), base, mutated); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+		b.Run(name+"/diff", func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := diffLogsidecarPatch(raw, mutated); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
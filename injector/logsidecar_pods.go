@@ -2,16 +2,23 @@ package injector
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"github.com/mattbaird/jsonpatch"
+	"go.opentelemetry.io/otel/attribute"
 	"k8s.io/api/admission/v1beta1"
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/klog"
 	"path/filepath"
+	"regexp"
+	"sort"
 	"strings"
+	"text/template"
 )
 
 const (
@@ -21,9 +28,41 @@ const (
 	logsidecarInitContainerName           = "logsidecar-init-container-logging-kubesphere-io"
 	logsidecarContainerName               = "logsidecar-container-logging-kubesphere-io"
 	logsidecarVolumeName                  = "logsidecar-config-volume-logging-kubesphere-io"
+	logsidecarInjectedHashAnnotationName  = "logging.kubesphere.io/logsidecar-injected-hash"
+	logsidecarStatusAnnotationName        = "logging.kubesphere.io/logsidecar-status"
+	logsidecarPathsAnnotationName         = "logging.kubesphere.io/logsidecar-paths"
+	logsidecarPartsAnnotationName         = "logging.kubesphere.io/logsidecar-injected-parts"
+	logsidecarConfigHashAnnotationName    = "logging.kubesphere.io/logsidecar-config-hash"
+	// logsidecarInjectedLabelName labels injected pods, so that they can be selected
+	logsidecarInjectedLabelName = "logging.kubesphere.io/logsidecar-injected"
+
+	logsidecarStatusInjected = "injected"
+	// logsidecarStatusSkipped is followed by the reason
+	logsidecarStatusSkipped = "skipped:"
 )
 
-func MutateLogsidecarPods(ar v1beta1.AdmissionReview) *v1beta1.AdmissionResponse {
+// MutateLogsidecarPods injects logsidecar into the pod of ar.
+func (i *Injector) MutateLogsidecarPods(ctx context.Context, ar v1beta1.AdmissionReview) *v1beta1.AdmissionResponse {
+	ctx, span := startSpan(ctx, "mutate pod",
+		attribute.String("admission.uid", string(ar.Request.UID)),
+		attribute.String("admission.operation", string(ar.Request.Operation)),
+		attribute.String("pod.namespace", ar.Request.Namespace),
+		attribute.String("pod.name", ar.Request.Name))
+	rec := newAuditRecord(ar, i.clock.Now())
+	resp := i.mutateLogsidecarPods(ctx, ar, rec)
+	rec.setResponse(resp)
+	i.Audit.Log(rec)
+	span.SetAttributes(attribute.String("admission.decision", rec.Decision),
+		attribute.Int("config.generation", int(rec.ConfigGeneration)))
+	var err error
+	if !resp.Allowed && resp.Result != nil {
+		err = errors.New(resp.Result.Message)
+	}
+	endSpan(span, err)
+	return resp
+}
+
+func (i *Injector) mutateLogsidecarPods(ctx context.Context, ar v1beta1.AdmissionReview, rec *AuditRecord) *v1beta1.AdmissionResponse {
 	klog.V(2).Info("inject logsidecar into pods")
 	podResource := metav1.GroupVersionResource{Group: "", Version: "v1", Resource: "pods"}
 	if ar.Request.Resource != podResource {
@@ -32,20 +71,61 @@ func MutateLogsidecarPods(ar v1beta1.AdmissionReview) *v1beta1.AdmissionResponse
 		return toAdmissionResponse(err)
 	}
 
-	raw := ar.Request.Object.Raw
-	pod := corev1.Pod{}
-	deserializer := codecs.UniversalDeserializer()
-	if _, _, err := deserializer.Decode(raw, nil, &pod); err != nil {
+	switch ar.Request.Operation {
+	case v1beta1.Create:
+		return i.mutateLogsidecarPodCreate(ctx, ar, rec)
+	case v1beta1.Update:
+		return i.mutateLogsidecarPodUpdate(ctx, ar, rec)
+	default:
+		return &v1beta1.AdmissionResponse{Allowed: true}
+	}
+}
+
+func (i *Injector) decodePod(ctx context.Context, raw []byte) (pod *corev1.Pod, err error) {
+	_, span := startSpan(ctx, "decode pod", attribute.Int("pod.size", len(raw)))
+	defer func() { endSpan(span, err) }()
+	if len(raw) == 0 {
+		err = fmt.Errorf("fail to decode admission request: no object")
+		klog.Error(err)
+		return nil, err
+	}
+	pod = &corev1.Pod{}
+	deserializer := i.codecs.UniversalDeserializer()
+	if _, _, err := deserializer.Decode(raw, nil, pod); err != nil {
 		err = fmt.Errorf("fail to decode admission request: %v", err)
 		klog.Error(err)
+		return nil, err
+	}
+	return pod, nil
+}
+
+func (i *Injector) mutateLogsidecarPodCreate(ctx context.Context, ar v1beta1.AdmissionReview, rec *AuditRecord) *v1beta1.AdmissionResponse {
+	raw := ar.Request.Object.Raw
+	pod, err := i.decodePod(ctx, raw)
+	if err != nil {
 		return toAdmissionResponse(err)
 	}
+	rec.setPod(pod)
 	reviewResponse := v1beta1.AdmissionResponse{}
 	reviewResponse.Allowed = true
 	podNN := pod.Namespace + ":" + pod.Name
-	podSpec := &pod.Spec
 
-	removeLogsidecarPart(podSpec)
+	iconfig := i.Configs.Get()
+	rec.setConfig(iconfig)
+	hash := injectionHash(pod, iconfig)
+	if pod.Annotations[logsidecarInjectedHashAnnotationName] == hash && hasLogsidecarPart(pod) {
+		klog.V(2).Infof("logsidecar of pod %s is up to date, skip injection", podNN)
+		rec.Decision, rec.Reason = AuditDecisionUnchanged, "logsidecar up to date"
+		return &reviewResponse
+	}
+
+	base := newPodPatch(pod)
+	removeLogsidecarPart(pod)
+	delete(pod.Annotations, logsidecarInjectedHashAnnotationName)
+	delete(pod.Annotations, logsidecarConfigHashAnnotationName)
+	delete(pod.Annotations, logsidecarStatusAnnotationName)
+	delete(pod.Annotations, logsidecarPathsAnnotationName)
+	delete(pod.Labels, logsidecarInjectedLabelName)
 
 	if confStr, exists := pod.Annotations[logsidecarAnnotationName]; exists {
 		if confStr = strings.TrimSpace(confStr); confStr != "" {
@@ -57,15 +137,40 @@ func MutateLogsidecarPods(ar v1beta1.AdmissionReview) *v1beta1.AdmissionResponse
 				return toAdmissionResponse(err)
 			}
 
-			if err = addLogsidecarPart(&pod, lscConfig); err != nil {
+			mounts, err := addLogsidecarPart(ctx, iconfig, pod, lscConfig)
+			if err != nil {
 				err = fmt.Errorf("faild to inject logsidecar into pod %s: %v", podNN, err)
 				klog.Error(err)
 				return toAdmissionResponse(err)
 			}
+			for _, warning := range mounts.Warnings {
+				klog.Warningf("pod %s: %s", podNN, warning)
+			}
+			reviewResponse.Warnings = mounts.Warnings
+			rec.Warnings, rec.LogPaths = mounts.Warnings, mounts.LogPaths
+			if hasLogsidecarPart(pod) {
+				// marshaling a string slice never fails
+				paths, _ := json.Marshal(mounts.LogPaths)
+				pod.Annotations[logsidecarInjectedHashAnnotationName] = hash
+				pod.Annotations[logsidecarConfigHashAnnotationName] = iconfig.Hash
+				pod.Annotations[logsidecarStatusAnnotationName] = logsidecarStatusInjected
+				pod.Annotations[logsidecarPathsAnnotationName] = string(paths)
+				if pod.Labels == nil {
+					pod.Labels = make(map[string]string)
+				}
+				pod.Labels[logsidecarInjectedLabelName] = "true"
+				rec.Decision, rec.Backend = AuditDecisionInjected, podBackend(pod, iconfig)
+			} else {
+				pod.Annotations[logsidecarStatusAnnotationName] = logsidecarStatusSkipped + "no log paths resolved"
+				rec.Decision, rec.Reason = AuditDecisionSkipped, "no log paths resolved"
+			}
+		} else {
+			pod.Annotations[logsidecarStatusAnnotationName] = logsidecarStatusSkipped + "empty config"
+			rec.Decision, rec.Reason = AuditDecisionSkipped, "empty config"
 		}
 	}
 
-	patch, err := createLogsidecarPatch(raw, &pod)
+	patch, err := createLogsidecarPatch(ctx, base, pod)
 	if err != nil {
 		err = fmt.Errorf("failed to create patch of pod %s: %v", podNN, err)
 		klog.Error(err)
@@ -80,85 +185,646 @@ func MutateLogsidecarPods(ar v1beta1.AdmissionReview) *v1beta1.AdmissionResponse
 	return &reviewResponse
 }
 
-func createLogsidecarPatch(raw []byte, mutated runtime.Object) ([]byte, error) {
-	mu, err := json.Marshal(mutated)
+// mutateLogsidecarPodUpdate leaves the containers of an updated pod untouched as they
+// are immutable. It refuses updates of the inputs of an injected pod, which would take
+// a different injection, and keeps the recorded injection and config hashes.
+func (i *Injector) mutateLogsidecarPodUpdate(ctx context.Context, ar v1beta1.AdmissionReview, rec *AuditRecord) *v1beta1.AdmissionResponse {
+	raw := ar.Request.Object.Raw
+	pod, err := i.decodePod(ctx, raw)
 	if err != nil {
-		return nil, err
+		return toAdmissionResponse(err)
 	}
-	patch, err := jsonpatch.CreatePatch(raw, mu)
+	oldPod, err := i.decodePod(ctx, ar.Request.OldObject.Raw)
 	if err != nil {
-		return nil, err
+		return toAdmissionResponse(err)
+	}
+	rec.setPod(pod)
+	reviewResponse := v1beta1.AdmissionResponse{}
+	reviewResponse.Allowed = true
+	podNN := pod.Namespace + ":" + pod.Name
+
+	if _, injected := oldPod.Annotations[logsidecarInjectedHashAnnotationName]; !injected {
+		return &reviewResponse
+	}
+	iconfig := i.Configs.Get()
+	rec.setConfig(iconfig)
+	if injectionHash(pod, iconfig) != injectionHash(oldPod, iconfig) {
+		err := fmt.Errorf("refuse to change logsidecar inputs of injected pod %s, recreate the pod to apply them", podNN)
+		klog.Error(err)
+		return toAdmissionResponse(err)
+	}
+
+	base := newPodPatch(pod)
+	for _, name := range []string{logsidecarInjectedHashAnnotationName, logsidecarConfigHashAnnotationName} {
+		hash, ok := oldPod.Annotations[name]
+		if !ok || pod.Annotations[name] == hash {
+			continue
+		}
+		if pod.Annotations == nil {
+			pod.Annotations = make(map[string]string)
+		}
+		pod.Annotations[name] = hash
+	}
+	patch, err := createLogsidecarPatch(ctx, base, pod)
+	if err != nil {
+		err = fmt.Errorf("failed to create patch of pod %s: %v", podNN, err)
+		klog.Error(err)
+		return toAdmissionResponse(err)
 	}
-	if len(patch) > 0 {
-		return json.Marshal(patch)
+	if patch != nil {
+		reviewResponse.Patch = patch
+		patchType := v1beta1.PatchTypeJSONPatch
+		reviewResponse.PatchType = &patchType
+	}
+	return &reviewResponse
+}
+
+// injectionHash digests the inputs of injecting logsidecar into pod, i.e. the logsidecar
+// annotations and the containers they refer to, together with the generation of the
+// injector config. Containers added by other mutating webhooks don't change it.
+func injectionHash(pod *corev1.Pod, iconfig *InjectorConfig) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\n", iconfig.Hash)
+	for _, name := range []string{logsidecarAnnotationName, logsidecarSinkAnnotationName,
+		logsidecarFilebeatPatchAnnotationName, logsidecarVectorPatchAnnotationName} {
+		fmt.Fprintf(h, "%q\n", pod.Annotations[name])
+	}
+	lscConfig, _ := decodeLogsidecarConfig(pod.Annotations[logsidecarAnnotationName])
+	if lscConfig == nil {
+		return hex.EncodeToString(h.Sum(nil))
+	}
+	sidecarName := iconfig.names().Container
+	for _, c := range pod.Spec.Containers {
+		if _, ok := lscConfig.ContainerLogConfigs[c.Name]; !ok || c.Name == sidecarName {
+			continue
+		}
+		// marshaling these types never fails
+		b, _ := json.Marshal(corev1.Container{Name: c.Name, Env: c.Env, VolumeMounts: c.VolumeMounts})
+		fmt.Fprintf(h, "%s\n", b)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// createLogsidecarPatch returns the json patch taking the pod captured by base to pod,
+// or nil if pod is unchanged.
+func createLogsidecarPatch(ctx context.Context, base *podPatch, pod *corev1.Pod) (patchBytes []byte, err error) {
+	_, span := startSpan(ctx, "create patch")
+	defer func() {
+		span.SetAttributes(attribute.Int("patch.size", len(patchBytes)))
+		endSpan(span, err)
+	}()
+	if ops := base.operations(pod); len(ops) > 0 {
+		return json.Marshal(ops)
 	}
 	return nil, nil
 }
 
-func removeLogsidecarPart(podSpec *corev1.PodSpec) {
-	for i, c := range podSpec.InitContainers {
-		if c.Name == logsidecarInitContainerName {
-			podSpec.InitContainers = append(podSpec.InitContainers[:i], podSpec.InitContainers[i+1:]...)
+// injectedParts names the parts injected into a pod along with the logsidecar. They
+// are recorded in the annotation logsidecarPartsAnnotationName, so that they are told
+// apart from parts of the same names defined by the user.
+type injectedParts struct {
+	InitContainers []string `json:"initContainers,omitempty"`
+	Containers     []string `json:"containers,omitempty"`
+	Volumes        []string `json:"volumes,omitempty"`
+}
+
+// podInjectedParts returns the parts injected into pod, or nil if none was. Pods
+// injected before the parts were recorded are recognized by injectedByDefaultNames, and
+// their parts by the default names.
+func podInjectedParts(pod *corev1.Pod) *injectedParts {
+	if partsStr, ok := pod.Annotations[logsidecarPartsAnnotationName]; ok {
+		parts := &injectedParts{}
+		if err := json.Unmarshal([]byte(partsStr), parts); err == nil {
+			return parts
 		}
+		klog.Warningf("ignore invalid annotations[%s] of pod %s:%s", logsidecarPartsAnnotationName, pod.Namespace, pod.Name)
+	}
+	if !injectedByDefaultNames(pod) {
+		return nil
+	}
+	parts := &injectedParts{
+		InitContainers: []string{logsidecarInitContainerName},
+		Containers:     []string{logsidecarContainerName},
+		Volumes:        []string{logsidecarVolumeName, logsidecarSinkVolumeName},
 	}
-	for i, c := range podSpec.Containers {
+	// volumes mounted by the sidecar were injected along with it, unless mounted by
+	// other containers, see removeLogsidecarPart
+	for _, c := range pod.Spec.Containers {
 		if c.Name == logsidecarContainerName {
-			podSpec.Containers = append(podSpec.Containers[:i], podSpec.Containers[i+1:]...)
+			for _, vm := range c.VolumeMounts {
+				parts.Volumes = append(parts.Volumes, vm.Name)
+			}
 		}
 	}
-	for i, v := range podSpec.Volumes {
-		if v.Name == logsidecarVolumeName {
-			podSpec.Volumes = append(podSpec.Volumes[:i], podSpec.Volumes[i+1:]...)
+	return parts
+}
+
+// injectedByDefaultNames returns whether pod was injected before the parts were
+// recorded. Such pods have the injected hash or label, or were injected by the first
+// releases, which marked nothing but always injected the init container and the sidecar
+// of the default names together.
+func injectedByDefaultNames(pod *corev1.Pod) bool {
+	if _, ok := pod.Annotations[logsidecarInjectedHashAnnotationName]; ok {
+		return true
+	}
+	if pod.Labels[logsidecarInjectedLabelName] == "true" {
+		return true
+	}
+	initContainer, container := false, false
+	for _, c := range pod.Spec.InitContainers {
+		initContainer = initContainer || c.Name == logsidecarInitContainerName
+	}
+	for _, c := range pod.Spec.Containers {
+		container = container || c.Name == logsidecarContainerName
+	}
+	return initContainer && container
+}
+
+func hasLogsidecarPart(pod *corev1.Pod) bool {
+	parts := podInjectedParts(pod)
+	if parts == nil {
+		return false
+	}
+	for _, c := range pod.Spec.Containers {
+		if containsString(parts.Containers, c.Name) {
+			return true
 		}
 	}
+	return false
+}
+
+// removeLogsidecarPart removes the injected parts of pod, every entry of their names if
+// there are several. Volumes still mounted by the remaining containers are kept.
+func removeLogsidecarPart(pod *corev1.Pod) {
+	parts := podInjectedParts(pod)
+	delete(pod.Annotations, logsidecarPartsAnnotationName)
+	if parts == nil {
+		return
+	}
+	podSpec := &pod.Spec
+	podSpec.InitContainers = filterContainers(podSpec.InitContainers, parts.InitContainers)
+	podSpec.Containers = filterContainers(podSpec.Containers, parts.Containers)
+
+	mounted := make(map[string]bool)
+	for _, containers := range [][]corev1.Container{podSpec.InitContainers, podSpec.Containers} {
+		for _, c := range containers {
+			for _, vm := range c.VolumeMounts {
+				mounted[vm.Name] = true
+			}
+		}
+	}
+	var volumes []corev1.Volume
+	for _, v := range podSpec.Volumes {
+		if mounted[v.Name] || !containsString(parts.Volumes, v.Name) {
+			volumes = append(volumes, v)
+		}
+	}
+	podSpec.Volumes = volumes
+}
+
+// filterContainers returns a copy of containers without those of the given names.
+func filterContainers(containers []corev1.Container, names []string) []corev1.Container {
+	var filtered []corev1.Container
+	for _, c := range containers {
+		if !containsString(names, c.Name) {
+			filtered = append(filtered, c)
+		}
+	}
+	return filtered
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
 }
 
 const (
-	logsidecarConfigDir    = "/etc/logsidecar"
-	filebeatConfigFileName = "filebeat.yaml"
-	vectorConfigFileName   = "vector.yaml"
+	logsidecarConfigDir      = "/etc/logsidecar"
+	logsidecarLogMountPrefix = "/container-"
+	filebeatConfigFileName   = "filebeat.yaml"
+	vectorConfigFileName     = "vector.yaml"
 )
 
-func addLogsidecarPart(pod *corev1.Pod, conf *LogsidecarConfig) error {
-	cvmMap := make(map[string]map[string]string) // containerName: volumeName: mountPath
-	for _, c := range pod.Spec.Containers {
-		if len(c.VolumeMounts) == 0 {
+// parseVolumeRef splits a volume key of VolumeLogConfig into the volume name and
+// an optional mount path, given as "<volumeName>:<mountPath>", which selects one
+// of the mounts when a container mounts the volume more than once.
+func parseVolumeRef(ref string) (volumeName, mountPath string) {
+	if i := strings.Index(ref, ":"); i >= 0 {
+		return ref[:i], filepath.Clean(ref[i+1:])
+	}
+	return ref, ""
+}
+
+// mountLogPaths is a mount of an application volume together with the log paths,
+// relative to the mount path, to be collected below it.
+type mountLogPaths struct {
+	Mount         corev1.VolumeMount
+	RelativePaths []string
+}
+
+// resolveMountLogPaths resolves the log paths configured for volumeRef against the
+// mounts of container c. A relative path applies to every mount of the volume unless
+// volumeRef selects one by its mount path. An absolute path is a path within c and
+// applies to the innermost mount of the volume containing it. Log paths which cannot
+// be resolved are dropped with a warning.
+func resolveMountLogPaths(c *corev1.Container, volumeRef string, logPaths []string) ([]mountLogPaths, []string) {
+	volumeName, selectedMountPath := parseVolumeRef(volumeRef)
+	var resolved []mountLogPaths
+	for _, vm := range c.VolumeMounts {
+		if vm.Name != volumeName {
 			continue
 		}
-		vmMap := make(map[string]string) // volumeName: mountPath
-		for _, vm := range c.VolumeMounts {
-			vmMap[vm.Name] = vm.MountPath
+		if selectedMountPath != "" && filepath.Clean(vm.MountPath) != selectedMountPath {
+			continue
 		}
-		cvmMap[c.Name] = vmMap
+		resolved = append(resolved, mountLogPaths{Mount: vm})
 	}
-	var volumeMounts []corev1.VolumeMount
-	var filebeatLogPaths []string
-	for containerName, vpMap := range conf.ContainerLogConfigs {
-		for volumeName, logRelativePaths := range vpMap {
-			if len(logRelativePaths) == 0 {
+
+	var warnings []string
+	for _, logPath := range logPaths {
+		if logPath = strings.TrimSpace(logPath); logPath == "" {
+			continue
+		}
+		if len(resolved) == 0 {
+			warnings = append(warnings, fmt.Sprintf("log path %s dropped: volume %s is not mounted in container %s",
+				logPath, volumeRef, c.Name))
+			continue
+		}
+		if !filepath.IsAbs(logPath) {
+			for i := range resolved {
+				resolved[i].RelativePaths = append(resolved[i].RelativePaths, logPath)
+			}
+			continue
+		}
+		logPath = filepath.Clean(logPath)
+		innermost, relativePath := -1, ""
+		for i, r := range resolved {
+			rel, err := filepath.Rel(filepath.Clean(r.Mount.MountPath), logPath)
+			if err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
 				continue
 			}
-			if volumeMountMap, ok := cvmMap[containerName]; ok {
-				if mountPath, ok := volumeMountMap[volumeName]; ok {
-					mountPath := filepath.Clean(fmt.Sprintf("/container-%s/%s", containerName, mountPath))
-					volumeMounts = append(volumeMounts, corev1.VolumeMount{
-						Name: volumeName, MountPath: mountPath})
-					for _, relativePath := range logRelativePaths {
-						if relativePath = strings.TrimSpace(relativePath); relativePath != "" {
-							filebeatLogPaths = append(filebeatLogPaths,
-								filepath.Clean(fmt.Sprintf("%s/%s", mountPath, relativePath)))
-						}
+			if innermost < 0 || len(r.Mount.MountPath) > len(resolved[innermost].Mount.MountPath) {
+				innermost, relativePath = i, rel
+			}
+		}
+		if innermost < 0 {
+			warnings = append(warnings, fmt.Sprintf("log path %s dropped: not on volume %s in container %s",
+				logPath, volumeRef, c.Name))
+			continue
+		}
+		resolved[innermost].RelativePaths = append(resolved[innermost].RelativePaths, relativePath)
+	}
+
+	var filtered []mountLogPaths
+	for _, r := range resolved {
+		if len(r.RelativePaths) > 0 {
+			filtered = append(filtered, r)
+		}
+	}
+	return filtered, warnings
+}
+
+var envRefRegexp = regexp.MustCompile(`\$\(([^)]+)\)`)
+
+// subPathExprEnv returns the env vars of container c referenced by subPathExpr, and the
+// ones their values refer to ahead of them, which the sidecar needs to expand the
+// expression the same way. A var of envFrom is referenced by the key of its config map
+// or secret. It returns the names of the referenced vars c does not define, too.
+func subPathExprEnv(c *corev1.Container, subPathExpr string) ([]corev1.EnvVar, []string, error) {
+	var envs []corev1.EnvVar
+	var undefined []string
+	seen := make(map[string]bool)
+	// resolve resolves the vars referenced by expr, of which the first defined env vars
+	// of c are visible, like the kubelet expands the value of an env var with the ones
+	// defined before it
+	var resolve func(expr string, defined int) error
+	resolve = func(expr string, defined int) error {
+		for _, m := range envRefRegexp.FindAllStringSubmatch(expr, -1) {
+			name := m[1]
+			if seen[name] {
+				continue
+			}
+			seen[name] = true
+			if env, i := lastEnv(c.Env[:defined], name); i >= 0 {
+				if env.ValueFrom == nil {
+					if err := resolve(env.Value, i); err != nil {
+						return err
 					}
 				}
+				envs = append(envs, env)
+				continue
+			}
+			env, ok, err := envFromEnv(c, name)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				undefined = append(undefined, name)
+				continue
 			}
+			envs = append(envs, env)
 		}
+		return nil
+	}
+	if err := resolve(subPathExpr, len(c.Env)); err != nil {
+		return nil, nil, err
 	}
+	return envs, undefined, nil
+}
 
-	if len(filebeatLogPaths) == 0 {
-		return nil
+// lastEnv returns the last of envs named name, which overrides the ones before, and its
+// index, or -1 if there is none.
+func lastEnv(envs []corev1.EnvVar, name string) (corev1.EnvVar, int) {
+	for i := len(envs) - 1; i >= 0; i-- {
+		if envs[i].Name == name {
+			return envs[i], i
+		}
+	}
+	return corev1.EnvVar{}, -1
+}
+
+// envFromEnv returns the env var name of the envFrom of container c as a reference to
+// the key of its config map or secret, optional like the keys of envFrom are. The keys
+// are unknown at admission, so the var can't be resolved if several sources may define it.
+func envFromEnv(c *corev1.Container, name string) (corev1.EnvVar, bool, error) {
+	var env corev1.EnvVar
+	found := false
+	for _, source := range c.EnvFrom {
+		if !strings.HasPrefix(name, source.Prefix) || name == source.Prefix {
+			continue
+		}
+		if found {
+			return env, false, fmt.Errorf("env %s referenced by subPathExpr of container %s may be defined by several envFrom sources",
+				name, c.Name)
+		}
+		found = true
+		key, optional := strings.TrimPrefix(name, source.Prefix), true
+		switch {
+		case source.ConfigMapRef != nil:
+			env = corev1.EnvVar{Name: name, ValueFrom: &corev1.EnvVarSource{ConfigMapKeyRef: &corev1.ConfigMapKeySelector{
+				LocalObjectReference: source.ConfigMapRef.LocalObjectReference, Key: key, Optional: &optional}}}
+		case source.SecretRef != nil:
+			env = corev1.EnvVar{Name: name, ValueFrom: &corev1.EnvVarSource{SecretKeyRef: &corev1.SecretKeySelector{
+				LocalObjectReference: source.SecretRef.LocalObjectReference, Key: key, Optional: &optional}}}
+		}
+	}
+	return env, found, nil
+}
+
+// mergeEnv appends env to envs unless a var of the same name is present already,
+// in which case both have to be defined the same.
+func mergeEnv(envs []corev1.EnvVar, env corev1.EnvVar) ([]corev1.EnvVar, error) {
+	for _, e := range envs {
+		if e.Name == env.Name {
+			if !equality.Semantic.DeepEqual(e, env) {
+				return nil, fmt.Errorf("env %s is defined differently", env.Name)
+			}
+			return envs, nil
+		}
+	}
+	return append(envs, env), nil
+}
+
+// sidecarEnv merges the env vars the sidecar requires, i.e. the ones referred to by
+// subPathExpr and the ones of the checkpoint and the sink, with the env of the sidecar
+// config by name. The required ones take precedence, and have to be defined the same if
+// they share a name. Of the vars of the sidecar config, a later one overrides an earlier
+// one like in a container, and the ones overridden by a required one are returned as
+// warnings.
+func sidecarEnv(required [][]corev1.EnvVar, configured []corev1.EnvVar) ([]corev1.EnvVar, []string, error) {
+	var envs []corev1.EnvVar
+	for _, r := range required {
+		for _, env := range r {
+			var err error
+			if envs, err = mergeEnv(envs, env); err != nil {
+				return nil, nil, fmt.Errorf("%v by the injector", err)
+			}
+		}
+	}
+	numRequired := len(envs)
+	var warnings []string
+	for i, env := range configured {
+		if _, j := lastEnv(configured[i+1:], env.Name); j >= 0 {
+			continue
+		}
+		if required, j := lastEnv(envs[:numRequired], env.Name); j >= 0 {
+			if !equality.Semantic.DeepEqual(required, env) {
+				warnings = append(warnings, fmt.Sprintf("env %s of the sidecar config overridden by the one required by the injector", env.Name))
+			}
+			continue
+		}
+		envs = append(envs, env)
+	}
+	return envs, warnings, nil
+}
+
+// containerMountLogPaths are the log paths of a mount of Container.
+type containerMountLogPaths struct {
+	mountLogPaths
+	Container *corev1.Container
+}
+
+// resolveSubPathExprEnv sets the env of mounts to the env vars the sub-path expressions
+// of resolved refer to. The sidecar has a single env for all of its mounts, so a var
+// has to be defined the same in all containers referring to it, or in none. Then equal
+// expressions expand the same in the sidecar as in each container, which allows their
+// mounts to be shared.
+func resolveSubPathExprEnv(resolved []containerMountLogPaths, mounts *logsidecarMounts) error {
+	// undefinedIn holds a container for each var it refers to without defining it
+	undefinedIn := make(map[string]string)
+	var undefinedNames []string
+	warned := make(map[string]bool)
+	for _, r := range resolved {
+		if r.Mount.SubPathExpr == "" {
+			continue
+		}
+		envs, undefined, err := subPathExprEnv(r.Container, r.Mount.SubPathExpr)
+		if err != nil {
+			return err
+		}
+		for _, env := range envs {
+			if mounts.Env, err = mergeEnv(mounts.Env, env); err != nil {
+				return fmt.Errorf("%v in container %s than in another container referring to it by subPathExpr, "+
+					"so the sidecar can't expand both expressions", err, r.Container.Name)
+			}
+		}
+		for _, name := range undefined {
+			if _, ok := undefinedIn[name]; !ok {
+				undefinedIn[name] = r.Container.Name
+				undefinedNames = append(undefinedNames, name)
+			}
+			warning := fmt.Sprintf("env %s referenced by subPathExpr of container %s is not defined", name, r.Container.Name)
+			if !warned[warning] {
+				warned[warning] = true
+				mounts.Warnings = append(mounts.Warnings, warning)
+			}
+		}
+	}
+	for _, name := range undefinedNames {
+		if _, i := lastEnv(mounts.Env, name); i >= 0 {
+			return fmt.Errorf("env %s referenced by subPathExpr is not defined in container %s but in another container, "+
+				"so the sidecar can't expand both expressions", name, undefinedIn[name])
+		}
+	}
+	return nil
+}
+
+// sharedSubPath returns the path below the sidecar mount vm at which the files of
+// a mount of the same volume with subPath and subPathExpr are found, if vm shares them.
+func sharedSubPath(vm corev1.VolumeMount, subPath, subPathExpr string) (string, bool) {
+	if vm.SubPathExpr != "" || subPathExpr != "" {
+		return "", vm.SubPathExpr == subPathExpr && vm.SubPath == subPath
+	}
+	rel, err := filepath.Rel(filepath.Clean("/"+vm.SubPath), filepath.Clean("/"+subPath))
+	if err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+		return "", false
+	}
+	return rel, true
+}
+
+// logsidecarMounts is what the sidecar mounts to collect the configured log paths.
+type logsidecarMounts struct {
+	VolumeMounts []corev1.VolumeMount
+	// Env holds the env vars the sub-path expressions of VolumeMounts refer to
+	Env      []corev1.EnvVar
+	LogPaths []string
+	// Warnings tell which configured log paths were dropped and why, and which env vars
+	// of the sidecar are undefined or overridden
+	Warnings []string
+}
+
+// resolveLogsidecarMounts resolves conf against the containers of pod into the volume
+// mounts of the sidecar, the env vars these need and the log paths within the sidecar.
+// Mounts of the same volume and sub-path, or a sub-path below an already mounted one,
+// share one sidecar mount so that no file is collected twice. Log paths are cleaned,
+// deduplicated and sorted. The volumes of a container are mounted below the log mount
+// directory of names for the container.
+func resolveLogsidecarMounts(pod *corev1.Pod, conf *LogsidecarConfig, names NamesConfig) (*logsidecarMounts, error) {
+	mounts := &logsidecarMounts{}
+	containerNames := make([]string, 0, len(conf.ContainerLogConfigs))
+	for containerName := range conf.ContainerLogConfigs {
+		containerNames = append(containerNames, containerName)
+	}
+	sort.Strings(containerNames)
+	for _, containerName := range containerNames {
+		found := false
+		for _, c := range pod.Spec.Containers {
+			found = found || c.Name == containerName
+		}
+		if !found {
+			mounts.Warnings = append(mounts.Warnings, fmt.Sprintf("log paths of container %s dropped: container not found", containerName))
+		}
+	}
+
+	var resolved []containerMountLogPaths
+	for i := range pod.Spec.Containers {
+		c := &pod.Spec.Containers[i]
+		volumeLogConfig := conf.ContainerLogConfigs[c.Name]
+		volumeRefs := make([]string, 0, len(volumeLogConfig))
+		for volumeRef := range volumeLogConfig {
+			volumeRefs = append(volumeRefs, volumeRef)
+		}
+		sort.Strings(volumeRefs)
+		for _, volumeRef := range volumeRefs {
+			rs, warnings := resolveMountLogPaths(c, volumeRef, volumeLogConfig[volumeRef])
+			for _, r := range rs {
+				resolved = append(resolved, containerMountLogPaths{mountLogPaths: r, Container: c})
+			}
+			mounts.Warnings = append(mounts.Warnings, warnings...)
+		}
+	}
+	// mounts of the broadest sub-path go first to be shared by the narrower ones
+	sort.SliceStable(resolved, func(i, j int) bool {
+		mi, mj := resolved[i].Mount, resolved[j].Mount
+		if mi.Name != mj.Name {
+			return mi.Name < mj.Name
+		}
+		if mi.SubPathExpr != mj.SubPathExpr {
+			return mi.SubPathExpr < mj.SubPathExpr
+		}
+		if si, sj := filepath.Clean("/"+mi.SubPath), filepath.Clean("/"+mj.SubPath); si != sj {
+			return si < sj
+		}
+		if resolved[i].Container.Name != resolved[j].Container.Name {
+			return resolved[i].Container.Name < resolved[j].Container.Name
+		}
+		return filepath.Clean(mi.MountPath) < filepath.Clean(mj.MountPath)
+	})
+
+	if err := resolveSubPathExprEnv(resolved, mounts); err != nil {
+		return nil, err
+	}
+
+	logPathSet := make(map[string]struct{})
+	for _, r := range resolved {
+		var mountPath string
+		for _, vm := range mounts.VolumeMounts {
+			if vm.Name != r.Mount.Name {
+				continue
+			}
+			if rel, ok := sharedSubPath(vm, r.Mount.SubPath, r.Mount.SubPathExpr); ok {
+				mountPath = filepath.Join(vm.MountPath, rel)
+				break
+			}
+		}
+		if mountPath == "" {
+			mountPath = filepath.Join(names.logMountDir(r.Container.Name), r.Mount.MountPath)
+			mounts.VolumeMounts = append(mounts.VolumeMounts, corev1.VolumeMount{
+				Name:        r.Mount.Name,
+				MountPath:   mountPath,
+				SubPath:     r.Mount.SubPath,
+				SubPathExpr: r.Mount.SubPathExpr,
+			})
+		}
+		for _, relativePath := range r.RelativePaths {
+			logPathSet[filepath.Clean(fmt.Sprintf("%s/%s", mountPath, relativePath))] = struct{}{}
+		}
+	}
+
+	for logPath := range logPathSet {
+		mounts.LogPaths = append(mounts.LogPaths, logPath)
+	}
+	sort.Strings(mounts.LogPaths)
+	return mounts, nil
+}
+
+// resolveLogsidecarConfig resolves conf against pod into the mounts of the sidecar, and
+// the sink of pod if conf resolves to any log path.
+func resolveLogsidecarConfig(ctx context.Context, iconfig *InjectorConfig, pod *corev1.Pod, conf *LogsidecarConfig) (_ *logsidecarMounts, _ *SinkConfig, err error) {
+	_, span := startSpan(ctx, "resolve config")
+	defer func() { endSpan(span, err) }()
+	mounts, err := resolveLogsidecarMounts(pod, conf, iconfig.names())
+	if err != nil {
+		return nil, nil, err
+	}
+	span.SetAttributes(attribute.Int("logsidecar.paths", len(mounts.LogPaths)))
+	if len(mounts.LogPaths) == 0 {
+		return mounts, nil, nil
+	}
+	sink, err := podSink(pod, iconfig)
+	if err != nil {
+		return nil, nil, err
 	}
+	return mounts, sink, nil
+}
 
-	iconfig := GetInjectorConfig()
+// templateContext is what the sidecar config templates are executed with.
+type templateContext struct {
+	// Paths are the log paths within the sidecar
+	Paths []string
+	// Sink is the backend to ship logs to, or nil for stdout
+	Sink *sinkContext
+	// DataDir is the directory within the sidecar to keep the checkpoints in
+	DataDir string
+}
+
+// renderSidecarConfig renders the sidecar config of pod from the template of iconfig
+// and the jsonpatch annotation of pod, and returns it with the name of its file.
+func renderSidecarConfig(ctx context.Context, iconfig *InjectorConfig, pod *corev1.Pod, logPaths []string, sc *sinkContext) (string, string, error) {
 	tmpl := iconfig.VectorConfigTemplate
 	jsonPatch, _ := pod.Annotations[logsidecarVectorPatchAnnotationName]
 	configFile := vectorConfigFileName
@@ -168,57 +834,177 @@ func addLogsidecarPart(pod *corev1.Pod, conf *LogsidecarConfig) error {
 		configFile = filebeatConfigFileName
 	}
 
-	// echo command writes filebeat config to volume shared by filebeat container
-	var buffer bytes.Buffer
-	if err := tmpl.Execute(&buffer, struct {
-		Paths []string
-	}{filebeatLogPaths}); err != nil {
-		return err
+	configYaml, err := executeSidecarTemplate(ctx, tmpl, pod, templateContext{Paths: logPaths, Sink: sc, DataDir: iconfig.names().DataDir})
+	if err != nil {
+		return "", configFile, err
 	}
-	configYaml := buffer.String()
 	if jsonPatch = strings.TrimSpace(jsonPatch); jsonPatch != "" {
+		_, span := startSpan(ctx, "patch config", attribute.String("config.file", configFile))
 		newYaml, err := PatchYaml(configYaml, jsonPatch)
+		endSpan(span, err)
 		if err != nil {
-			return err
+			return "", configFile, err
 		}
 		configYaml = newYaml
 	}
-	configEcho := JoinLines(configYaml, "echo \"",
-		fmt.Sprintf("\" >> %s/%s ; ", logsidecarConfigDir, configFile))
+	return configYaml, configFile, nil
+}
+
+func executeSidecarTemplate(ctx context.Context, tmpl *template.Template, pod *corev1.Pod, data templateContext) (_ string, err error) {
+	_, span := startSpan(ctx, "render template", attribute.String("template.name", tmpl.Name()))
+	defer func() { endSpan(span, err) }()
+	tmpl, err = podTemplate(tmpl, pod)
+	if err != nil {
+		return "", err
+	}
+	var buffer bytes.Buffer
+	if err := tmpl.Execute(&buffer, data); err != nil {
+		return "", err
+	}
+	return buffer.String(), nil
+}
+
+// addLogsidecarPart injects the logsidecar into pod unless conf resolves to no log
+// paths. It returns the resolved mounts and log paths of the sidecar.
+func addLogsidecarPart(ctx context.Context, iconfig *InjectorConfig, pod *corev1.Pod, conf *LogsidecarConfig) (*logsidecarMounts, error) {
+	mounts, sink, err := resolveLogsidecarConfig(ctx, iconfig, pod, conf)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(mounts.LogPaths) == 0 {
+		return mounts, nil
+	}
+	names := iconfig.names()
+	sc, sinkEnvs, sinkVolume, sinkVolumeMount := sinkPart(sink, names)
+
+	configYaml, configFile, err := renderSidecarConfig(ctx, iconfig, pod, mounts.LogPaths, sc)
+	if err != nil {
+		return nil, err
+	}
+	// echo command writes filebeat config to volume shared by filebeat container
+	configEcho := JoinLines(escapeDoubleQuoted(configYaml), "echo \"",
+		fmt.Sprintf("\" >> %s/%s ; ", names.ConfigDir, configFile))
 
 	logsidecarVolume := corev1.Volume{
-		Name:         logsidecarVolumeName,
+		Name:         names.ConfigVolume,
 		VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}},
 	}
 	logsidecarVolumeMount := corev1.VolumeMount{
-		Name:      logsidecarVolumeName,
-		MountPath: logsidecarConfigDir,
-	}
-	pod.Spec.Volumes = append(pod.Spec.Volumes, logsidecarVolume)
-	pod.Spec.InitContainers = append(pod.Spec.InitContainers, corev1.Container{
-		Name:            logsidecarInitContainerName,
-		Image:           iconfig.SidecarConfig.InitContainer.Image,
-		ImagePullPolicy: iconfig.SidecarConfig.InitContainer.ImagePullPolicy,
-		Resources:       iconfig.SidecarConfig.InitContainer.Resources,
+		Name:      names.ConfigVolume,
+		MountPath: names.ConfigDir,
+	}
+	checkpointVolume, checkpointVolumeMount, checkpointEnvs := checkpointPart(&iconfig.SidecarConfig.Checkpoint, names)
+	volumes := append([]corev1.Volume{logsidecarVolume, checkpointVolume}, iconfig.SidecarConfig.Volumes...)
+	initContainer := iconfig.SidecarConfig.InitContainer
+	logsidecarInitContainer := corev1.Container{
+		Name:            names.InitContainer,
+		Image:           initContainer.Image,
+		ImagePullPolicy: initContainer.ImagePullPolicy,
+		Resources:       initContainer.Resources,
 		Command:         []string{"/bin/sh"},
 		Args:            []string{"-c", configEcho},
-		VolumeMounts:    []corev1.VolumeMount{logsidecarVolumeMount},
-	})
-	image := iconfig.SidecarConfig.VectorContainer.Image
-	imagePullPolicy := iconfig.SidecarConfig.VectorContainer.ImagePullPolicy
-	resources := iconfig.SidecarConfig.VectorContainer.Resources
+		Env:             initContainer.Env,
+		EnvFrom:         initContainer.EnvFrom,
+		VolumeMounts:    append([]corev1.VolumeMount{logsidecarVolumeMount}, initContainer.VolumeMounts...),
+	}
+	container := iconfig.SidecarConfig.VectorContainer
 	if iconfig.SidecarType == SidecarTypeFilebeat {
-		image = iconfig.SidecarConfig.FilebeatContainer.Image
-		imagePullPolicy = iconfig.SidecarConfig.FilebeatContainer.ImagePullPolicy
-		resources = iconfig.SidecarConfig.FilebeatContainer.Resources
-	}
-	pod.Spec.Containers = append(pod.Spec.Containers, corev1.Container{
-		Name:            logsidecarContainerName,
-		Image:           image,
-		ImagePullPolicy: imagePullPolicy,
-		Resources:       resources,
-		Args:            []string{"-c", fmt.Sprintf("%s/%s", logsidecarConfigDir, configFile)},
-		VolumeMounts:    append(volumeMounts, logsidecarVolumeMount),
-	})
+		container = iconfig.SidecarConfig.FilebeatContainer
+	}
+	envs, warnings, err := sidecarEnv([][]corev1.EnvVar{mounts.Env, checkpointEnvs, sinkEnvs}, container.Env)
+	if err != nil {
+		return nil, err
+	}
+	mounts.Warnings = append(mounts.Warnings, warnings...)
+	volumeMounts := append(append([]corev1.VolumeMount{}, mounts.VolumeMounts...), logsidecarVolumeMount, checkpointVolumeMount)
+	if sinkVolume != nil {
+		volumes = append(volumes, *sinkVolume)
+		volumeMounts = append(volumeMounts, *sinkVolumeMount)
+	}
+	volumeMounts = append(volumeMounts, container.VolumeMounts...)
+	logsidecarContainer := corev1.Container{
+		Name:            names.Container,
+		Image:           container.Image,
+		ImagePullPolicy: container.ImagePullPolicy,
+		Resources:       container.Resources,
+		Args:            []string{"-c", fmt.Sprintf("%s/%s", names.ConfigDir, configFile)},
+		Env:             envs,
+		EnvFrom:         container.EnvFrom,
+		VolumeMounts:    volumeMounts,
+	}
+
+	if err = checkCollisions(pod, []corev1.Container{logsidecarInitContainer, logsidecarContainer}, volumes); err != nil {
+		return nil, err
+	}
+	pod.Spec.Volumes = append(pod.Spec.Volumes, volumes...)
+	pod.Spec.InitContainers = append(pod.Spec.InitContainers, logsidecarInitContainer)
+	pod.Spec.Containers = append(pod.Spec.Containers, logsidecarContainer)
+
+	parts := injectedParts{
+		InitContainers: []string{names.InitContainer},
+		Containers:     []string{names.Container},
+		Volumes:        []string{names.ConfigVolume, names.CheckpointVolume},
+	}
+	for _, v := range iconfig.SidecarConfig.Volumes {
+		parts.Volumes = append(parts.Volumes, v.Name)
+	}
+	if sinkVolume != nil {
+		parts.Volumes = append(parts.Volumes, sinkVolume.Name)
+	}
+	// marshaling these types never fails
+	partsStr, _ := json.Marshal(parts)
+	if pod.Annotations == nil {
+		pod.Annotations = make(map[string]string)
+	}
+	pod.Annotations[logsidecarPartsAnnotationName] = string(partsStr)
+	return mounts, nil
+}
+
+// checkCollisions checks that the containers and volumes to inject into pod collide with
+// none of pod, which the apiserver would reject with errors hard to trace back to the
+// injection. No two mounts of an injected container may share the mount path, and the
+// mounts of the log volumes of pod may not be at, above or below those of the injected
+// volumes, which they would hide or be hidden by.
+func checkCollisions(pod *corev1.Pod, containers []corev1.Container, volumes []corev1.Volume) error {
+	for _, podContainers := range [][]corev1.Container{pod.Spec.InitContainers, pod.Spec.Containers} {
+		for _, pc := range podContainers {
+			for _, c := range containers {
+				if pc.Name == c.Name {
+					return fmt.Errorf("container %s collides with the injected container of the same name", pc.Name)
+				}
+			}
+		}
+	}
+	injectedVolumes := make(map[string]bool, len(volumes))
+	for _, v := range volumes {
+		injectedVolumes[v.Name] = true
+	}
+	for _, v := range pod.Spec.Volumes {
+		if injectedVolumes[v.Name] {
+			return fmt.Errorf("volume %s collides with the injected volume of the same name", v.Name)
+		}
+	}
+
+	for _, c := range containers {
+		for i, vm := range c.VolumeMounts {
+			for _, other := range c.VolumeMounts[:i] {
+				mountPath, otherPath := filepath.Clean(vm.MountPath), filepath.Clean(other.MountPath)
+				if mountPath == otherPath {
+					return fmt.Errorf("mount path %s of volume %s collides with the mount of volume %s in container %s",
+						mountPath, vm.Name, other.Name, c.Name)
+				}
+				if injectedVolumes[vm.Name] != injectedVolumes[other.Name] && pathOverlaps(mountPath, otherPath) {
+					return fmt.Errorf("mount path %s of volume %s overlaps mount path %s of volume %s in container %s",
+						mountPath, vm.Name, otherPath, other.Name, c.Name)
+				}
+			}
+		}
+	}
 	return nil
 }
+
+// pathOverlaps tells whether one of the clean absolute paths a and b is below the other.
+func pathOverlaps(a, b string) bool {
+	return strings.HasPrefix(a, strings.TrimSuffix(b, "/")+"/") || strings.HasPrefix(b, strings.TrimSuffix(a, "/")+"/")
+}
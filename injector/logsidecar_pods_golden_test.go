@@ -0,0 +1,129 @@
+package injector
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"k8s.io/api/admission/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/yaml"
+)
+
+var update = flag.Bool("update", false, "update golden files of testdata")
+
+// shippedConfig writes the configmap shipped in config/configmap.yaml to a temporary
+// directory, and returns the config of the given sidecar type to load it from there.
+func shippedConfig(tb testing.TB, sidecarType string) *Config {
+	content, err := ioutil.ReadFile(filepath.Join("..", "config", "configmap.yaml"))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	var cm corev1.ConfigMap
+	if err = yaml.Unmarshal(content, &cm); err != nil {
+		tb.Fatal(err)
+	}
+	dir := tb.TempDir()
+	for name, data := range cm.Data {
+		if err = ioutil.WriteFile(filepath.Join(dir, name), []byte(data), 0644); err != nil {
+			tb.Fatal(err)
+		}
+	}
+	return &Config{
+		SidecarType:        sidecarType,
+		SidecarConfigFile:  filepath.Join(dir, "sidecar.yaml"),
+		FilebeatConfigFile: filepath.Join(dir, "filebeat.yaml"),
+		VectorConfigFile:   filepath.Join(dir, "vector.yaml"),
+	}
+}
+
+// loadShippedInjectorConfig loads the injector config of the given sidecar type from
+// the configmap shipped in config/configmap.yaml.
+func loadShippedInjectorConfig(tb testing.TB, sidecarType string) *InjectorConfig {
+	ic, err := shippedConfig(tb, sidecarType).InjectorConfig()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return ic
+}
+
+func mutateGoldenPod(t *testing.T, inj *Injector, podFile string) []byte {
+	content, err := ioutil.ReadFile(podFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// serialize the pod the way the apiserver sends it
+	var pod corev1.Pod
+	if err = yaml.Unmarshal(content, &pod); err != nil {
+		t.Fatal(err)
+	}
+	raw, err := json.Marshal(&pod)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp := inj.MutateLogsidecarPods(context.Background(), v1beta1.AdmissionReview{Request: &v1beta1.AdmissionRequest{
+		Resource:  metav1.GroupVersionResource{Version: "v1", Resource: "pods"},
+		Operation: v1beta1.Create,
+		Object:    runtime.RawExtension{Raw: raw},
+	}})
+	if resp.Result != nil {
+		t.Fatal(resp.Result.Message)
+	}
+	var out bytes.Buffer
+	if len(resp.Patch) > 0 {
+		if err = json.Indent(&out, resp.Patch, "", "  "); err != nil {
+			t.Fatal(err)
+		}
+		out.WriteString("\n")
+	}
+	return out.Bytes()
+}
+
+func TestLogsidecarPodMutateGolden(t *testing.T) {
+	podFiles, err := filepath.Glob(filepath.Join("testdata", "golden", "*.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, sidecarType := range []string{SidecarTypeVector, SidecarTypeFilebeat} {
+		sidecarType := sidecarType
+		t.Run(sidecarType, func(t *testing.T) {
+			// injectors of different configs run side by side
+			t.Parallel()
+			inj := newTestInjector(loadShippedInjectorConfig(t, sidecarType))
+			for _, podFile := range podFiles {
+				podFile := podFile
+				name := strings.TrimSuffix(filepath.Base(podFile), ".yaml")
+				t.Run(name, func(t *testing.T) {
+					got := mutateGoldenPod(t, inj, podFile)
+					for i := 0; i < 10; i++ {
+						if again := mutateGoldenPod(t, inj, podFile); !bytes.Equal(got, again) {
+							t.Fatalf("patch differs between admissions of the same pod:\n%s\n%s", got, again)
+						}
+					}
+
+					goldenFile := strings.TrimSuffix(podFile, ".yaml") + "." + sidecarType + ".golden"
+					if *update {
+						if err := ioutil.WriteFile(goldenFile, got, 0644); err != nil {
+							t.Fatal(err)
+						}
+					}
+					expected, err := ioutil.ReadFile(goldenFile)
+					if err != nil && !os.IsNotExist(err) {
+						t.Fatal(err)
+					}
+					if !bytes.Equal(expected, got) {
+						t.Errorf("patch does not match %s, run go test with -update to update it:\n%s", goldenFile, got)
+					}
+				})
+			}
+		})
+	}
+}
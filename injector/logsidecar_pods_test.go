@@ -2,13 +2,26 @@ package injector
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
 	"fmt"
-	"github.com/stretchr/testify/assert"
-	corev1 "k8s.io/api/core/v1"
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"math/rand"
 	"path/filepath"
+	"reflect"
+	"strconv"
 	"testing"
+	"testing/quick"
 	"text/template"
+	"time"
+
+	jsonpatch "github.com/evanphx/json-patch"
+	"github.com/stretchr/testify/assert"
+	"k8s.io/api/admission/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/clock"
 )
 
 func TestLogsidecarPodMutate(t *testing.T) {
@@ -30,7 +43,8 @@ logging.level: warning
 	if err != nil {
 		panic(err)
 	}
-	injectorConfig = &InjectorConfig{
+	iconfig := &InjectorConfig{
+		SidecarType:            SidecarTypeFilebeat,
 		FilebeatConfigTemplate: tmpl,
 	}
 
@@ -62,14 +76,14 @@ logging.level: warning
 	if err != nil {
 		panic(err)
 	}
-	err = addLogsidecarPart(&mutatedPod.Spec, lscConfig, "")
+	_, err = addLogsidecarPart(context.Background(), iconfig, mutatedPod, lscConfig)
 	if err != nil {
 		panic(err)
 	}
 
 	expectedPod := pod.DeepCopy()
 	var buffer bytes.Buffer
-	if err := injectorConfig.FilebeatConfigTemplate.Execute(&buffer, struct {
+	if err := iconfig.FilebeatConfigTemplate.Execute(&buffer, struct {
 		Paths []string
 	}{[]string{filepath.Clean("/container-app-container/data/log/*.log")}}); err != nil {
 		panic(err)
@@ -79,9 +93,9 @@ logging.level: warning
 
 	expectedPod.Spec.InitContainers = []corev1.Container{{
 		Name:            logsidecarInitContainerName,
-		Image:           injectorConfig.SidecarConfig.InitContainer.Image,
-		ImagePullPolicy: injectorConfig.SidecarConfig.InitContainer.ImagePullPolicy,
-		Resources:       injectorConfig.SidecarConfig.InitContainer.Resources,
+		Image:           iconfig.SidecarConfig.InitContainer.Image,
+		ImagePullPolicy: iconfig.SidecarConfig.InitContainer.ImagePullPolicy,
+		Resources:       iconfig.SidecarConfig.InitContainer.Resources,
 		Command:         []string{"/bin/sh"},
 		Args:            []string{"-c", fbConfigEcho},
 		VolumeMounts: []corev1.VolumeMount{{
@@ -91,9 +105,9 @@ logging.level: warning
 	}}
 	expectedPod.Spec.Containers = append(pod.Spec.Containers, corev1.Container{
 		Name:            logsidecarContainerName,
-		Image:           injectorConfig.SidecarConfig.Container.Image,
-		ImagePullPolicy: injectorConfig.SidecarConfig.Container.ImagePullPolicy,
-		Resources:       injectorConfig.SidecarConfig.Container.Resources,
+		Image:           iconfig.SidecarConfig.FilebeatContainer.Image,
+		ImagePullPolicy: iconfig.SidecarConfig.FilebeatContainer.ImagePullPolicy,
+		Resources:       iconfig.SidecarConfig.FilebeatContainer.Resources,
 		Args:            []string{"-c", fmt.Sprintf("%s/%s", logsidecarConfigDir, filebeatConfigFileName)},
 		VolumeMounts: []corev1.VolumeMount{{
 			Name:      "datavolume",
@@ -101,12 +115,20 @@ logging.level: warning
 		}, {
 			Name:      logsidecarVolumeName,
 			MountPath: logsidecarConfigDir,
+		}, {
+			Name:      logsidecarCheckpointVolumeName,
+			MountPath: logsidecarDataDir,
 		}},
 	})
 	expectedPod.Spec.Volumes = append(pod.Spec.Volumes, corev1.Volume{
 		Name:         logsidecarVolumeName,
 		VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}},
+	}, corev1.Volume{
+		Name:         logsidecarCheckpointVolumeName,
+		VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}},
 	})
+	expectedPod.Annotations[logsidecarPartsAnnotationName] = fmt.Sprintf(`{"initContainers":[%q],"containers":[%q],"volumes":[%q,%q]}`,
+		logsidecarInitContainerName, logsidecarContainerName, logsidecarVolumeName, logsidecarCheckpointVolumeName)
 
 	//bs1, err := yaml.Marshal(expectedPod)
 	//if err != nil {
@@ -122,3 +144,1002 @@ logging.level: warning
 
 	assert.Equal(t, expectedPod, mutatedPod)
 }
+
+func TestLogsidecarPodMutateSubPath(t *testing.T) {
+	iconfig := newFilebeatPathsConfig(t)
+
+	podNameEnv := corev1.EnvVar{
+		Name:      "POD_NAME",
+		ValueFrom: &corev1.EnvVarSource{FieldRef: &corev1.ObjectFieldSelector{FieldPath: "metadata.name"}},
+	}
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Annotations: map[string]string{
+				logsidecarAnnotationName: `{"containerLogConfigs": {"app-container": {"datavolume:/data/app2": ["*.log"], "podvolume": ["*.log"]}}}`,
+			},
+		},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{{
+				Name: "app-container",
+				Env:  []corev1.EnvVar{{Name: "FOO", Value: "bar"}, podNameEnv},
+				VolumeMounts: []corev1.VolumeMount{
+					{Name: "datavolume", MountPath: "/data/app1", SubPath: "app1"},
+					{Name: "datavolume", MountPath: "/data/app2", SubPath: "app2"},
+					{Name: "podvolume", MountPath: "/pod", SubPathExpr: "logs/$(POD_NAME)"},
+				},
+			}},
+		},
+	}
+	lscConfig, err := decodeLogsidecarConfig(pod.Annotations[logsidecarAnnotationName])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = addLogsidecarPart(context.Background(), iconfig, pod, lscConfig); err != nil {
+		t.Fatal(err)
+	}
+
+	sidecar := pod.Spec.Containers[len(pod.Spec.Containers)-1]
+	assert.Equal(t, logsidecarContainerName, sidecar.Name)
+	assert.ElementsMatch(t, []corev1.VolumeMount{
+		{Name: "datavolume", MountPath: "/container-app-container/data/app2", SubPath: "app2"},
+		{Name: "podvolume", MountPath: "/container-app-container/pod", SubPathExpr: "logs/$(POD_NAME)"},
+		{Name: logsidecarVolumeName, MountPath: logsidecarConfigDir},
+		{Name: logsidecarCheckpointVolumeName, MountPath: logsidecarDataDir},
+	}, sidecar.VolumeMounts)
+	assert.Equal(t, []corev1.EnvVar{podNameEnv}, sidecar.Env)
+}
+
+func TestResolveMountLogPaths(t *testing.T) {
+	container := &corev1.Container{
+		Name: "app-container",
+		VolumeMounts: []corev1.VolumeMount{
+			{Name: "datavolume", MountPath: "/data"},
+			{Name: "datavolume", MountPath: "/data/app1", SubPath: "app1"},
+			{Name: "datavolume", MountPath: "/var/app2", SubPath: "app2"},
+			{Name: "othervolume", MountPath: "/other"},
+		},
+	}
+	tests := []struct {
+		name      string
+		volumeRef string
+		logPaths  []string
+		expected  []mountLogPaths
+		dropped   int // number of dropped log paths
+	}{{
+		name:      "single mount",
+		volumeRef: "othervolume",
+		logPaths:  []string{"*.log"},
+		expected:  []mountLogPaths{{Mount: container.VolumeMounts[3], RelativePaths: []string{"*.log"}}},
+	}, {
+		name:      "relative path applies to every mount",
+		volumeRef: "datavolume",
+		logPaths:  []string{"log/*.log", " "},
+		expected: []mountLogPaths{
+			{Mount: container.VolumeMounts[0], RelativePaths: []string{"log/*.log"}},
+			{Mount: container.VolumeMounts[1], RelativePaths: []string{"log/*.log"}},
+			{Mount: container.VolumeMounts[2], RelativePaths: []string{"log/*.log"}},
+		},
+	}, {
+		name:      "mount selected by mount path",
+		volumeRef: "datavolume:/var/app2/",
+		logPaths:  []string{"log/*.log"},
+		expected:  []mountLogPaths{{Mount: container.VolumeMounts[2], RelativePaths: []string{"log/*.log"}}},
+	}, {
+		name:      "absolute path resolved against innermost mount",
+		volumeRef: "datavolume",
+		logPaths:  []string{"/data/app1/log/*.log", "/data/log/*.log", "/var/app2/*.log"},
+		expected: []mountLogPaths{
+			{Mount: container.VolumeMounts[0], RelativePaths: []string{"log/*.log"}},
+			{Mount: container.VolumeMounts[1], RelativePaths: []string{"log/*.log"}},
+			{Mount: container.VolumeMounts[2], RelativePaths: []string{"*.log"}},
+		},
+	}, {
+		name:      "absolute path outside of the volume",
+		volumeRef: "datavolume",
+		logPaths:  []string{"/other/*.log", "/datalog/*.log"},
+		dropped:   2,
+	}, {
+		name:      "absolute path outside of the selected mount",
+		volumeRef: "datavolume:/data",
+		logPaths:  []string{"/var/app2/*.log"},
+		dropped:   1,
+	}, {
+		name:      "unknown mount path",
+		volumeRef: "datavolume:/unknown",
+		logPaths:  []string{"*.log"},
+		dropped:   1,
+	}, {
+		name:      "unknown volume",
+		volumeRef: "unknown",
+		logPaths:  []string{"*.log"},
+		dropped:   1,
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resolved, warnings := resolveMountLogPaths(container, tt.volumeRef, tt.logPaths)
+			assert.Equal(t, tt.expected, resolved)
+			assert.Len(t, warnings, tt.dropped)
+		})
+	}
+}
+
+func TestSubPathExprEnv(t *testing.T) {
+	optional := true
+	podNameEnv := corev1.EnvVar{Name: "POD_NAME",
+		ValueFrom: &corev1.EnvVarSource{FieldRef: &corev1.ObjectFieldSelector{FieldPath: "metadata.name"}}}
+	appConfig := corev1.LocalObjectReference{Name: "app-config"}
+	appSecret := corev1.LocalObjectReference{Name: "app-secret"}
+	tests := []struct {
+		name              string
+		container         corev1.Container
+		subPathExpr       string
+		expectedEnv       []corev1.EnvVar
+		expectedUndefined []string
+		expectedErr       bool
+	}{{
+		name:        "env",
+		container:   corev1.Container{Env: []corev1.EnvVar{{Name: "FOO", Value: "bar"}, podNameEnv}},
+		subPathExpr: "logs/$(POD_NAME)",
+		expectedEnv: []corev1.EnvVar{podNameEnv},
+	}, {
+		name: "transitive",
+		container: corev1.Container{Env: []corev1.EnvVar{podNameEnv, {Name: "LOG_DIR", Value: "$(APP)/$(POD_NAME)"},
+			{Name: "APP", Value: "defined after LOG_DIR"}}},
+		subPathExpr:       "$(LOG_DIR)",
+		expectedEnv:       []corev1.EnvVar{podNameEnv, {Name: "LOG_DIR", Value: "$(APP)/$(POD_NAME)"}},
+		expectedUndefined: []string{"APP"},
+	}, {
+		name:        "later env overrides",
+		container:   corev1.Container{Env: []corev1.EnvVar{{Name: "APP", Value: "a"}, {Name: "APP", Value: "b"}}},
+		subPathExpr: "$(APP)",
+		expectedEnv: []corev1.EnvVar{{Name: "APP", Value: "b"}},
+	}, {
+		name: "envFrom",
+		container: corev1.Container{
+			EnvFrom: []corev1.EnvFromSource{{ConfigMapRef: &corev1.ConfigMapEnvSource{LocalObjectReference: appConfig}}},
+			Env:     []corev1.EnvVar{{Name: "LOG_DIR", Value: "$(APP)/logs"}},
+		},
+		subPathExpr: "$(LOG_DIR)",
+		expectedEnv: []corev1.EnvVar{
+			{Name: "APP", ValueFrom: &corev1.EnvVarSource{ConfigMapKeyRef: &corev1.ConfigMapKeySelector{
+				LocalObjectReference: appConfig, Key: "APP", Optional: &optional}}},
+			{Name: "LOG_DIR", Value: "$(APP)/logs"},
+		},
+	}, {
+		name: "envFrom with prefix",
+		container: corev1.Container{EnvFrom: []corev1.EnvFromSource{
+			{Prefix: "CONFIG_", ConfigMapRef: &corev1.ConfigMapEnvSource{LocalObjectReference: appConfig}},
+			{Prefix: "SECRET_", SecretRef: &corev1.SecretEnvSource{LocalObjectReference: appSecret}},
+		}},
+		subPathExpr: "$(SECRET_APP)",
+		expectedEnv: []corev1.EnvVar{{Name: "SECRET_APP", ValueFrom: &corev1.EnvVarSource{SecretKeyRef: &corev1.SecretKeySelector{
+			LocalObjectReference: appSecret, Key: "APP", Optional: &optional}}}},
+	}, {
+		name: "env overrides envFrom",
+		container: corev1.Container{
+			EnvFrom: []corev1.EnvFromSource{{ConfigMapRef: &corev1.ConfigMapEnvSource{LocalObjectReference: appConfig}}},
+			Env:     []corev1.EnvVar{{Name: "APP", Value: "app"}},
+		},
+		subPathExpr: "$(APP)",
+		expectedEnv: []corev1.EnvVar{{Name: "APP", Value: "app"}},
+	}, {
+		name: "several envFrom sources",
+		container: corev1.Container{EnvFrom: []corev1.EnvFromSource{
+			{ConfigMapRef: &corev1.ConfigMapEnvSource{LocalObjectReference: appConfig}},
+			{SecretRef: &corev1.SecretEnvSource{LocalObjectReference: appSecret}},
+		}},
+		subPathExpr: "$(APP)",
+		expectedErr: true,
+	}, {
+		name:              "undefined",
+		container:         corev1.Container{Env: []corev1.EnvVar{podNameEnv}},
+		subPathExpr:       "$(APP)/$(POD_NAME)",
+		expectedEnv:       []corev1.EnvVar{podNameEnv},
+		expectedUndefined: []string{"APP"},
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.container.Name = "app-container"
+			env, undefined, err := subPathExprEnv(&tt.container, tt.subPathExpr)
+			if tt.expectedErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expectedEnv, env)
+			assert.Equal(t, tt.expectedUndefined, undefined)
+		})
+	}
+}
+
+func TestLogsidecarPodMutateMultipleMounts(t *testing.T) {
+	iconfig := newFilebeatPathsConfig(t)
+
+	pod := &corev1.Pod{
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{{
+				Name: "app-container",
+				VolumeMounts: []corev1.VolumeMount{
+					{Name: "datavolume", MountPath: "/data"},
+					{Name: "datavolume", MountPath: "/data/app1", SubPath: "app1"},
+				},
+			}},
+		},
+	}
+	_, err := addLogsidecarPart(context.Background(), iconfig, pod, &LogsidecarConfig{ContainerLogConfigs: ContainerLogConfigs{
+		"app-container": {"datavolume": {"/data/app1/*.log", "/data/*.log"}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sidecar := pod.Spec.Containers[len(pod.Spec.Containers)-1]
+	assert.Equal(t, []corev1.VolumeMount{
+		{Name: "datavolume", MountPath: "/container-app-container/data"},
+		{Name: logsidecarVolumeName, MountPath: logsidecarConfigDir},
+		{Name: logsidecarCheckpointVolumeName, MountPath: logsidecarDataDir},
+	}, sidecar.VolumeMounts)
+	assert.Contains(t, pod.Spec.InitContainers[0].Args[1], "- /container-app-container/data/app1/*.log")
+	assert.Contains(t, pod.Spec.InitContainers[0].Args[1], "- /container-app-container/data/*.log")
+}
+
+func TestResolveLogsidecarMounts(t *testing.T) {
+	tests := []struct {
+		name                 string
+		containers           []corev1.Container
+		conf                 ContainerLogConfigs
+		expectedVolumeMounts []corev1.VolumeMount
+		expectedEnv          []corev1.EnvVar
+		expectedLogPaths     []string
+		// expectedError is empty if the mounts are resolved
+		expectedError string
+	}{{
+		name: "volume shared by containers",
+		containers: []corev1.Container{{
+			Name:         "b",
+			VolumeMounts: []corev1.VolumeMount{{Name: "datavolume", MountPath: "/data"}},
+		}, {
+			Name:         "a",
+			VolumeMounts: []corev1.VolumeMount{{Name: "datavolume", MountPath: "/var/data"}},
+		}},
+		conf: ContainerLogConfigs{
+			"a": {"datavolume": {"log/*.log", "./log//*.log"}},
+			"b": {"datavolume": {"log/*.log", "b.log"}},
+		},
+		expectedVolumeMounts: []corev1.VolumeMount{{Name: "datavolume", MountPath: "/container-a/var/data"}},
+		expectedLogPaths:     []string{"/container-a/var/data/b.log", "/container-a/var/data/log/*.log"},
+	}, {
+		name: "sub-path below a mounted sub-path",
+		containers: []corev1.Container{{
+			Name:         "a",
+			VolumeMounts: []corev1.VolumeMount{{Name: "datavolume", MountPath: "/data/app1", SubPath: "app1/"}},
+		}, {
+			Name:         "b",
+			VolumeMounts: []corev1.VolumeMount{{Name: "datavolume", MountPath: "/data", SubPath: "app1/log"}},
+		}, {
+			Name:         "c",
+			VolumeMounts: []corev1.VolumeMount{{Name: "datavolume", MountPath: "/data", SubPath: "app2"}},
+		}},
+		conf: ContainerLogConfigs{
+			"a": {"datavolume": {"*.log"}},
+			"b": {"datavolume": {"*.log"}},
+			"c": {"datavolume": {"*.log"}},
+		},
+		expectedVolumeMounts: []corev1.VolumeMount{
+			{Name: "datavolume", MountPath: "/container-a/data/app1", SubPath: "app1/"},
+			{Name: "datavolume", MountPath: "/container-c/data", SubPath: "app2"},
+		},
+		expectedLogPaths: []string{"/container-a/data/app1/*.log", "/container-a/data/app1/log/*.log", "/container-c/data/*.log"},
+	}, {
+		name: "same subPathExpr",
+		containers: []corev1.Container{{
+			Name:         "a",
+			VolumeMounts: []corev1.VolumeMount{{Name: "datavolume", MountPath: "/data", SubPathExpr: "$(POD_NAME)"}},
+		}, {
+			Name:         "b",
+			VolumeMounts: []corev1.VolumeMount{{Name: "datavolume", MountPath: "/data", SubPathExpr: "$(POD_NAME)"}},
+		}, {
+			Name:         "c",
+			VolumeMounts: []corev1.VolumeMount{{Name: "datavolume", MountPath: "/data"}},
+		}},
+		conf: ContainerLogConfigs{
+			"a": {"datavolume": {"*.log"}},
+			"b": {"datavolume": {"*.log"}},
+			"c": {"datavolume": {"*.log"}},
+		},
+		expectedVolumeMounts: []corev1.VolumeMount{
+			{Name: "datavolume", MountPath: "/container-c/data"},
+			{Name: "datavolume", MountPath: "/container-a/data", SubPathExpr: "$(POD_NAME)"},
+		},
+		expectedLogPaths: []string{"/container-a/data/*.log", "/container-c/data/*.log"},
+	}, {
+		name: "same subPathExpr with the same env",
+		containers: []corev1.Container{{
+			Name:         "a",
+			Env:          []corev1.EnvVar{{Name: "DIR", Value: "logs"}},
+			VolumeMounts: []corev1.VolumeMount{{Name: "datavolume", MountPath: "/data", SubPathExpr: "$(DIR)"}},
+		}, {
+			Name:         "b",
+			Env:          []corev1.EnvVar{{Name: "DIR", Value: "logs"}},
+			VolumeMounts: []corev1.VolumeMount{{Name: "datavolume", MountPath: "/var/data", SubPathExpr: "$(DIR)"}},
+		}},
+		conf: ContainerLogConfigs{
+			"a": {"datavolume": {"a.log"}},
+			"b": {"datavolume": {"b.log"}},
+		},
+		expectedVolumeMounts: []corev1.VolumeMount{{Name: "datavolume", MountPath: "/container-a/data", SubPathExpr: "$(DIR)"}},
+		expectedEnv:          []corev1.EnvVar{{Name: "DIR", Value: "logs"}},
+		expectedLogPaths:     []string{"/container-a/data/a.log", "/container-a/data/b.log"},
+	}, {
+		name: "same subPathExpr with different env",
+		containers: []corev1.Container{{
+			Name:         "a",
+			Env:          []corev1.EnvVar{{Name: "DIR", Value: "a"}},
+			VolumeMounts: []corev1.VolumeMount{{Name: "datavolume", MountPath: "/logs", SubPathExpr: "$(DIR)"}},
+		}, {
+			Name:         "b",
+			Env:          []corev1.EnvVar{{Name: "DIR", Value: "b"}},
+			VolumeMounts: []corev1.VolumeMount{{Name: "datavolume", MountPath: "/logs", SubPathExpr: "$(DIR)"}},
+		}},
+		conf: ContainerLogConfigs{
+			"a": {"datavolume": {"*.log"}},
+			"b": {"datavolume": {"*.log"}},
+		},
+		expectedError: "env DIR is defined differently in container b",
+	}, {
+		name: "same subPathExpr defined in one container only",
+		containers: []corev1.Container{{
+			Name:         "a",
+			Env:          []corev1.EnvVar{{Name: "DIR", Value: "a"}},
+			VolumeMounts: []corev1.VolumeMount{{Name: "datavolume", MountPath: "/logs", SubPathExpr: "$(DIR)"}},
+		}, {
+			Name:         "b",
+			VolumeMounts: []corev1.VolumeMount{{Name: "datavolume", MountPath: "/logs", SubPathExpr: "$(DIR)"}},
+		}},
+		conf: ContainerLogConfigs{
+			"a": {"datavolume": {"*.log"}},
+			"b": {"datavolume": {"*.log"}},
+		},
+		expectedError: "env DIR referenced by subPathExpr is not defined in container b",
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pod := &corev1.Pod{Spec: corev1.PodSpec{Containers: tt.containers}}
+			mounts, err := resolveLogsidecarMounts(pod, &LogsidecarConfig{ContainerLogConfigs: tt.conf}, NamesConfig{}.withDefaults())
+			if tt.expectedError != "" {
+				if assert.Error(t, err) {
+					assert.Contains(t, err.Error(), tt.expectedError)
+				}
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expectedEnv, mounts.Env)
+			assert.Equal(t, tt.expectedVolumeMounts, mounts.VolumeMounts)
+			assert.Equal(t, tt.expectedLogPaths, mounts.LogPaths)
+		})
+	}
+}
+
+// appPod returns a pod with the container app-container logging to *.log on the volume
+// datavolume mounted at /data, and the annotation to collect them.
+func appPod() *corev1.Pod {
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "app",
+			Namespace: "default",
+			Annotations: map[string]string{
+				logsidecarAnnotationName: `{"containerLogConfigs": {"app-container": {"datavolume": ["*.log"]}}}`,
+			},
+		},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{{
+				Name:         "app-container",
+				VolumeMounts: []corev1.VolumeMount{{Name: "datavolume", MountPath: "/data"}},
+			}},
+			Volumes: []corev1.Volume{{Name: "datavolume"}},
+		},
+	}
+}
+
+// newFilebeatPathsConfig returns the config of a filebeat sidecar whose template lists
+// the log paths only.
+func newFilebeatPathsConfig(t testing.TB) *InjectorConfig {
+	t.Helper()
+	tmpl, err := template.New("filebeat.yaml").Parse("paths:\n{{range .Paths}}- {{.}}\n{{end}}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &InjectorConfig{
+		SidecarType:            SidecarTypeFilebeat,
+		FilebeatConfigTemplate: tmpl,
+	}
+}
+
+// newTestInjector returns an Injector with the active config ic.
+func newTestInjector(ic *InjectorConfig) *Injector {
+	inj := newInjector(nil, clock.NewFakeClock(time.Date(2021, 7, 1, 0, 0, 0, 0, time.UTC)))
+	inj.Configs.set(ic)
+	return inj
+}
+
+func podAdmissionReview(t testing.TB, operation v1beta1.Operation, pod, oldPod *corev1.Pod) v1beta1.AdmissionReview {
+	raw, err := json.Marshal(pod)
+	if err != nil {
+		t.Fatal(err)
+	}
+	request := &v1beta1.AdmissionRequest{
+		Resource:  metav1.GroupVersionResource{Version: "v1", Resource: "pods"},
+		Operation: operation,
+		Object:    runtime.RawExtension{Raw: raw},
+	}
+	if oldPod != nil {
+		if request.OldObject.Raw, err = json.Marshal(oldPod); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return v1beta1.AdmissionReview{Request: request}
+}
+
+func applyAdmissionPatch(t *testing.T, ar v1beta1.AdmissionReview, resp *v1beta1.AdmissionResponse) *corev1.Pod {
+	raw := ar.Request.Object.Raw
+	if len(resp.Patch) > 0 {
+		patch, err := jsonpatch.DecodePatch(resp.Patch)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if raw, err = patch.Apply(raw); err != nil {
+			t.Fatal(err)
+		}
+	}
+	pod := &corev1.Pod{}
+	if err := json.Unmarshal(raw, pod); err != nil {
+		t.Fatal(err)
+	}
+	return pod
+}
+
+func TestLogsidecarPodReinjection(t *testing.T) {
+	iconfig := newFilebeatPathsConfig(t)
+	iconfig.Hash = "1"
+	inj := newTestInjector(iconfig)
+
+	pod := appPod()
+	ar := podAdmissionReview(t, v1beta1.Create, pod, nil)
+	resp := inj.MutateLogsidecarPods(context.Background(), ar)
+	assert.True(t, resp.Allowed)
+	injected := applyAdmissionPatch(t, ar, resp)
+	assert.Equal(t, injectionHash(pod, iconfig), injected.Annotations[logsidecarInjectedHashAnnotationName])
+	assert.True(t, hasLogsidecarPart(injected))
+
+	t.Run("create injected pod", func(t *testing.T) {
+		resp := inj.MutateLogsidecarPods(context.Background(), podAdmissionReview(t, v1beta1.Create, injected, nil))
+		assert.True(t, resp.Allowed)
+		assert.Empty(t, resp.Patch)
+	})
+
+	t.Run("create injected pod with changed config", func(t *testing.T) {
+		iconfig.Hash = "2"
+		defer func() { iconfig.Hash = "1" }()
+		ar := podAdmissionReview(t, v1beta1.Create, injected, nil)
+		resp := inj.MutateLogsidecarPods(context.Background(), ar)
+		assert.True(t, resp.Allowed)
+		reinjected := applyAdmissionPatch(t, ar, resp)
+		assert.Equal(t, injectionHash(pod, iconfig), reinjected.Annotations[logsidecarInjectedHashAnnotationName])
+		assert.Equal(t, "2", reinjected.Annotations[logsidecarConfigHashAnnotationName])
+		assert.Equal(t, len(injected.Spec.Containers), len(reinjected.Spec.Containers))
+		assert.Equal(t, len(injected.Spec.InitContainers), len(reinjected.Spec.InitContainers))
+	})
+
+	t.Run("update labels", func(t *testing.T) {
+		updated := injected.DeepCopy()
+		updated.Labels = map[string]string{"app": "test"}
+		resp := inj.MutateLogsidecarPods(context.Background(), podAdmissionReview(t, v1beta1.Update, updated, injected))
+		assert.True(t, resp.Allowed)
+		assert.Empty(t, resp.Patch)
+	})
+
+	t.Run("update with changed config", func(t *testing.T) {
+		iconfig.Hash = "2"
+		defer func() { iconfig.Hash = "1" }()
+		resp := inj.MutateLogsidecarPods(context.Background(), podAdmissionReview(t, v1beta1.Update, injected.DeepCopy(), injected))
+		assert.True(t, resp.Allowed)
+		assert.Empty(t, resp.Patch)
+	})
+
+	t.Run("update removing injected hash", func(t *testing.T) {
+		updated := injected.DeepCopy()
+		delete(updated.Annotations, logsidecarInjectedHashAnnotationName)
+		updated.Annotations[logsidecarConfigHashAnnotationName] = "0"
+		ar := podAdmissionReview(t, v1beta1.Update, updated, injected)
+		resp := inj.MutateLogsidecarPods(context.Background(), ar)
+		assert.True(t, resp.Allowed)
+		assert.Equal(t, injected.Annotations, applyAdmissionPatch(t, ar, resp).Annotations)
+	})
+
+	t.Run("update logsidecar config", func(t *testing.T) {
+		updated := injected.DeepCopy()
+		updated.Annotations[logsidecarAnnotationName] = `{"containerLogConfigs": {"app-container": {"datavolume": ["log/*.log"]}}}`
+		resp := inj.MutateLogsidecarPods(context.Background(), podAdmissionReview(t, v1beta1.Update, updated, injected))
+		assert.False(t, resp.Allowed)
+		assert.Empty(t, resp.Patch)
+	})
+
+	t.Run("update pod not injected", func(t *testing.T) {
+		updated := pod.DeepCopy()
+		updated.Annotations[logsidecarAnnotationName] = `{"containerLogConfigs": {"app-container": {"datavolume": ["log/*.log"]}}}`
+		resp := inj.MutateLogsidecarPods(context.Background(), podAdmissionReview(t, v1beta1.Update, updated, pod))
+		assert.True(t, resp.Allowed)
+		assert.Empty(t, resp.Patch)
+	})
+}
+
+func TestLogsidecarPodStatus(t *testing.T) {
+	iconfig := newFilebeatPathsConfig(t)
+	inj := newTestInjector(iconfig)
+
+	tests := []struct {
+		name             string
+		config           string
+		expectedStatus   string
+		expectedPaths    string
+		expectedWarnings int
+	}{{
+		name:           "injected",
+		config:         `{"containerLogConfigs": {"app-container": {"datavolume": ["*.log"]}}}`,
+		expectedStatus: logsidecarStatusInjected,
+		expectedPaths:  `["/container-app-container/data/*.log"]`,
+	}, {
+		name:             "injected with dropped paths",
+		config:           `{"containerLogConfigs": {"app-container": {"datavolume": ["*.log", "/var/*.log"], "unknown": ["*.log"]}, "unknown": {"datavolume": ["*.log"]}}}`,
+		expectedStatus:   logsidecarStatusInjected,
+		expectedPaths:    `["/container-app-container/data/*.log"]`,
+		expectedWarnings: 3,
+	}, {
+		name:             "no log paths",
+		config:           `{"containerLogConfigs": {"app-container": {"unknown": ["*.log"]}}}`,
+		expectedStatus:   logsidecarStatusSkipped + "no log paths resolved",
+		expectedWarnings: 1,
+	}, {
+		name:           "empty config",
+		config:         " ",
+		expectedStatus: logsidecarStatusSkipped + "empty config",
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pod := appPod()
+			pod.Annotations[logsidecarAnnotationName] = tt.config
+			ar := podAdmissionReview(t, v1beta1.Create, pod, nil)
+			resp := inj.MutateLogsidecarPods(context.Background(), ar)
+			assert.True(t, resp.Allowed)
+			assert.Len(t, resp.Warnings, tt.expectedWarnings)
+			mutated := applyAdmissionPatch(t, ar, resp)
+			assert.Equal(t, tt.expectedStatus, mutated.Annotations[logsidecarStatusAnnotationName])
+			assert.Equal(t, tt.expectedPaths, mutated.Annotations[logsidecarPathsAnnotationName])
+		})
+	}
+}
+
+func TestLogsidecarPodSidecarEnvAndVolumes(t *testing.T) {
+	tmpl, err := template.New("vector.yaml").Parse("password: ${ES_PASSWORD}\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	passwordEnv := corev1.EnvVar{Name: "ES_PASSWORD", ValueFrom: &corev1.EnvVarSource{SecretKeyRef: &corev1.SecretKeySelector{
+		LocalObjectReference: corev1.LocalObjectReference{Name: "es-credentials"}, Key: "password"}}}
+	envFrom := corev1.EnvFromSource{SecretRef: &corev1.SecretEnvSource{LocalObjectReference: corev1.LocalObjectReference{Name: "es-env"}}}
+	certsVolume := corev1.Volume{Name: "es-certs", VolumeSource: corev1.VolumeSource{Secret: &corev1.SecretVolumeSource{SecretName: "es-certs"}}}
+	certsVolumeMount := corev1.VolumeMount{Name: "es-certs", MountPath: "/etc/es-certs", ReadOnly: true}
+	iconfig := &InjectorConfig{
+		SidecarType:          SidecarTypeVector,
+		VectorConfigTemplate: tmpl,
+		SidecarConfig: SidecarConfig{
+			VectorContainer: ContainerConfig{
+				Env:          []corev1.EnvVar{passwordEnv},
+				EnvFrom:      []corev1.EnvFromSource{envFrom},
+				VolumeMounts: []corev1.VolumeMount{certsVolumeMount},
+			},
+			Volumes: []corev1.Volume{certsVolume},
+		},
+		Hash: "1",
+	}
+	inj := newTestInjector(iconfig)
+	pod := appPod()
+
+	ar := podAdmissionReview(t, v1beta1.Create, pod, nil)
+	injected := applyAdmissionPatch(t, ar, inj.MutateLogsidecarPods(context.Background(), ar))
+	sidecar := injected.Spec.Containers[len(injected.Spec.Containers)-1]
+	assert.Equal(t, logsidecarContainerName, sidecar.Name)
+	assert.Equal(t, []corev1.EnvVar{passwordEnv}, sidecar.Env)
+	assert.Equal(t, []corev1.EnvFromSource{envFrom}, sidecar.EnvFrom)
+	assert.Contains(t, sidecar.VolumeMounts, certsVolumeMount)
+	assert.Contains(t, injected.Spec.Volumes, certsVolume)
+	// the secret is not rendered into the config
+	assert.Contains(t, injected.Spec.InitContainers[0].Args[1], `password: \${ES_PASSWORD}`)
+
+	// vars required by the injector override the ones of the sidecar config
+	iconfig.SidecarConfig.Checkpoint.HostPath = "/var/lib/logsidecar"
+	iconfig.SidecarConfig.VectorContainer.Env = []corev1.EnvVar{passwordEnv, {Name: checkpointPodNameEnvName, Value: "app"}}
+	ar = podAdmissionReview(t, v1beta1.Create, pod, nil)
+	resp := inj.MutateLogsidecarPods(context.Background(), ar)
+	overridden := applyAdmissionPatch(t, ar, resp).Spec.Containers
+	assert.Equal(t, []corev1.EnvVar{
+		fieldRefEnv(checkpointPodNamespaceEnvName, "metadata.namespace"),
+		fieldRefEnv(checkpointPodNameEnvName, "metadata.name"),
+		passwordEnv,
+	}, overridden[len(overridden)-1].Env)
+	assert.Len(t, resp.Warnings, 1)
+	iconfig.SidecarConfig.Checkpoint.HostPath = ""
+	iconfig.SidecarConfig.VectorContainer.Env = []corev1.EnvVar{passwordEnv}
+
+	// volumes of the sidecar are replaced on re-injection, but not those of the app
+	iconfig.Hash = "2"
+	ar = podAdmissionReview(t, v1beta1.Create, injected, nil)
+	reinjected := applyAdmissionPatch(t, ar, inj.MutateLogsidecarPods(context.Background(), ar))
+	assert.Equal(t, injected.Spec.Volumes, reinjected.Spec.Volumes)
+}
+
+func TestSidecarEnv(t *testing.T) {
+	podNameEnv := fieldRefEnv(checkpointPodNameEnvName, "metadata.name")
+	passwordEnv := secretEnv(sinkPasswordEnvName, &corev1.SecretKeySelector{
+		LocalObjectReference: corev1.LocalObjectReference{Name: "es-credentials"}, Key: "password"})
+	tests := []struct {
+		name             string
+		required         [][]corev1.EnvVar
+		configured       []corev1.EnvVar
+		expectedEnv      []corev1.EnvVar
+		expectedWarnings int
+		expectedErr      bool
+	}{{
+		name:        "distinct",
+		required:    [][]corev1.EnvVar{{podNameEnv}, {passwordEnv}},
+		configured:  []corev1.EnvVar{{Name: "LOG_LEVEL", Value: "info"}},
+		expectedEnv: []corev1.EnvVar{podNameEnv, passwordEnv, {Name: "LOG_LEVEL", Value: "info"}},
+	}, {
+		name:        "required defined the same",
+		required:    [][]corev1.EnvVar{{podNameEnv}, {podNameEnv}},
+		configured:  []corev1.EnvVar{podNameEnv},
+		expectedEnv: []corev1.EnvVar{podNameEnv},
+	}, {
+		name:        "required defined differently",
+		required:    [][]corev1.EnvVar{{{Name: checkpointPodNameEnvName, Value: "app"}}, {podNameEnv}},
+		expectedErr: true,
+	}, {
+		name:             "configured overridden by required",
+		required:         [][]corev1.EnvVar{{podNameEnv}, {passwordEnv}},
+		configured:       []corev1.EnvVar{{Name: sinkPasswordEnvName, Value: "changeme"}, {Name: "LOG_LEVEL", Value: "info"}},
+		expectedEnv:      []corev1.EnvVar{podNameEnv, passwordEnv, {Name: "LOG_LEVEL", Value: "info"}},
+		expectedWarnings: 1,
+	}, {
+		name:        "later configured overrides earlier",
+		configured:  []corev1.EnvVar{{Name: "LOG_LEVEL", Value: "info"}, {Name: "TZ", Value: "UTC"}, {Name: "LOG_LEVEL", Value: "debug"}},
+		expectedEnv: []corev1.EnvVar{{Name: "TZ", Value: "UTC"}, {Name: "LOG_LEVEL", Value: "debug"}},
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			envs, warnings, err := sidecarEnv(tt.required, tt.configured)
+			if tt.expectedErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expectedEnv, envs)
+			assert.Len(t, warnings, tt.expectedWarnings)
+		})
+	}
+}
+
+func TestLogsidecarPodNames(t *testing.T) {
+	iconfig := loadShippedInjectorConfig(t, SidecarTypeVector)
+	iconfig.SidecarConfig.Names = NamesConfig{InitContainer: "log-init", Container: "log",
+		ConfigVolume: "log-config", ConfigDir: "/etc/log", LogMountPrefix: "/logs/"}
+	inj := newTestInjector(iconfig)
+
+	ar := podAdmissionReview(t, v1beta1.Create, appPod(), nil)
+	injected := applyAdmissionPatch(t, ar, inj.MutateLogsidecarPods(context.Background(), ar))
+	assert.Equal(t, "log-init", injected.Spec.InitContainers[0].Name)
+	assert.Contains(t, injected.Spec.InitContainers[0].Args[1], `" >> /etc/log/vector.yaml`)
+	sidecar := injected.Spec.Containers[1]
+	assert.Equal(t, "log", sidecar.Name)
+	assert.Equal(t, []string{"-c", "/etc/log/vector.yaml"}, sidecar.Args)
+	assert.Equal(t, []corev1.VolumeMount{
+		{Name: "datavolume", MountPath: "/logs/app-container/data"},
+		{Name: "log-config", MountPath: "/etc/log"},
+		{Name: logsidecarCheckpointVolumeName, MountPath: logsidecarDataDir},
+	}, sidecar.VolumeMounts)
+	assert.Equal(t, `["/logs/app-container/data/*.log"]`, injected.Annotations[logsidecarPathsAnnotationName])
+
+	// parts injected by other names are removed on re-injection
+	iconfig.SidecarConfig.Names = NamesConfig{}
+	iconfig.Hash = "renamed"
+	ar = podAdmissionReview(t, v1beta1.Create, injected, nil)
+	reinjected := applyAdmissionPatch(t, ar, inj.MutateLogsidecarPods(context.Background(), ar))
+	var containers, volumes []string
+	for _, c := range append(reinjected.Spec.InitContainers, reinjected.Spec.Containers...) {
+		containers = append(containers, c.Name)
+	}
+	for _, v := range reinjected.Spec.Volumes {
+		volumes = append(volumes, v.Name)
+	}
+	assert.Equal(t, []string{logsidecarInitContainerName, "app-container", logsidecarContainerName}, containers)
+	assert.Equal(t, []string{"datavolume", logsidecarVolumeName, logsidecarCheckpointVolumeName}, volumes)
+
+	// containers of the pod must not have the names of the injected ones
+	pod := appPod()
+	pod.Spec.InitContainers = []corev1.Container{{Name: logsidecarInitContainerName}}
+	ar = podAdmissionReview(t, v1beta1.Create, pod, nil)
+	resp := inj.MutateLogsidecarPods(context.Background(), ar)
+	assert.False(t, resp.Allowed)
+	assert.Contains(t, resp.Result.Message, "container "+logsidecarInitContainerName+" collides")
+}
+
+func TestLogsidecarPodCollisions(t *testing.T) {
+	certsVolume := corev1.Volume{Name: "certs"}
+	tests := []struct {
+		name         string
+		pod          func(pod *corev1.Pod)
+		volumeMounts []corev1.VolumeMount
+		// expectedError is empty if the injection is allowed
+		expectedError string
+	}{{
+		name: "nested log mounts",
+		pod: func(pod *corev1.Pod) {
+			pod.Annotations[logsidecarAnnotationName] = `{"containerLogConfigs": {"app-container": {"datavolume": ["*.log"], "logvolume": ["*.log"]}}}`
+			pod.Spec.Volumes = append(pod.Spec.Volumes, corev1.Volume{Name: "logvolume"})
+			pod.Spec.Containers[0].VolumeMounts = append(pod.Spec.Containers[0].VolumeMounts,
+				corev1.VolumeMount{Name: "logvolume", MountPath: "/data/logs"})
+		},
+	}, {
+		name: "container",
+		pod: func(pod *corev1.Pod) {
+			pod.Spec.Containers = append(pod.Spec.Containers, corev1.Container{Name: logsidecarContainerName})
+		},
+		expectedError: "container " + logsidecarContainerName + " collides",
+	}, {
+		name: "config volume",
+		pod: func(pod *corev1.Pod) {
+			pod.Spec.Volumes = append(pod.Spec.Volumes, corev1.Volume{Name: logsidecarVolumeName})
+		},
+		expectedError: "volume " + logsidecarVolumeName + " collides with the injected volume",
+	}, {
+		name:          "sidecar volume",
+		pod:           func(pod *corev1.Pod) { pod.Spec.Volumes = append(pod.Spec.Volumes, certsVolume) },
+		volumeMounts:  []corev1.VolumeMount{{Name: "certs", MountPath: "/etc/certs"}},
+		expectedError: "volume certs collides with the injected volume",
+	}, {
+		name:          "same mount path",
+		volumeMounts:  []corev1.VolumeMount{{Name: "certs", MountPath: "/container-app-container/data/"}},
+		expectedError: "mount path /container-app-container/data of volume certs collides with the mount of volume datavolume",
+	}, {
+		name:          "mount path above log mount",
+		volumeMounts:  []corev1.VolumeMount{{Name: "certs", MountPath: "/container-app-container"}},
+		expectedError: "mount path /container-app-container of volume certs overlaps mount path /container-app-container/data of volume datavolume",
+	}, {
+		name:          "mount path below log mount",
+		volumeMounts:  []corev1.VolumeMount{{Name: "certs", MountPath: "/container-app-container/data/certs"}},
+		expectedError: "mount path /container-app-container/data/certs of volume certs overlaps mount path /container-app-container/data",
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			iconfig := loadShippedInjectorConfig(t, SidecarTypeVector)
+			if tt.volumeMounts != nil {
+				iconfig.SidecarConfig.Volumes = []corev1.Volume{certsVolume}
+				iconfig.SidecarConfig.VectorContainer.VolumeMounts = tt.volumeMounts
+			}
+			pod := appPod()
+			if tt.pod != nil {
+				tt.pod(pod)
+			}
+			ar := podAdmissionReview(t, v1beta1.Create, pod, nil)
+			resp := newTestInjector(iconfig).MutateLogsidecarPods(context.Background(), ar)
+			if tt.expectedError == "" {
+				assert.True(t, resp.Allowed)
+				assert.NotEmpty(t, resp.Patch)
+				return
+			}
+			if assert.False(t, resp.Allowed) {
+				assert.Contains(t, resp.Result.Message, tt.expectedError)
+			}
+		})
+	}
+}
+
+// randomPod is a pod of random containers and volumes for the property tests of
+// removeLogsidecarPart. Names are drawn from a few, among them the names of the injected
+// parts, so that they repeat and user parts share names with injected ones.
+type randomPod struct {
+	*corev1.Pod
+}
+
+func (randomPod) Generate(r *rand.Rand, size int) reflect.Value {
+	containerNames := []string{"app", "proxy", logsidecarContainerName, logsidecarInitContainerName}
+	volumeNames := []string{"data", "certs", logsidecarVolumeName, logsidecarSinkVolumeName, "sidecar-extra"}
+	pick := func(names []string) []string {
+		var picked []string
+		for _, name := range names {
+			if r.Intn(3) == 0 {
+				picked = append(picked, name)
+			}
+		}
+		return picked
+	}
+	containers := func() []corev1.Container {
+		var cs []corev1.Container
+		for i := r.Intn(size + 1); i > 0; i-- {
+			c := corev1.Container{Name: containerNames[r.Intn(len(containerNames))], Image: strconv.Itoa(r.Int())}
+			for _, name := range pick(volumeNames) {
+				c.VolumeMounts = append(c.VolumeMounts, corev1.VolumeMount{Name: name, MountPath: "/" + name})
+			}
+			cs = append(cs, c)
+		}
+		return cs
+	}
+
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{}}}
+	pod.Spec.InitContainers = containers()
+	pod.Spec.Containers = containers()
+	for i := r.Intn(size + 1); i > 0; i-- {
+		pod.Spec.Volumes = append(pod.Spec.Volumes, corev1.Volume{Name: volumeNames[r.Intn(len(volumeNames))]})
+	}
+	switch r.Intn(3) {
+	case 1:
+		// injected before the parts were recorded
+		pod.Annotations[logsidecarInjectedHashAnnotationName] = "hash"
+	case 2:
+		parts, _ := json.Marshal(injectedParts{
+			InitContainers: pick(containerNames),
+			Containers:     pick(containerNames),
+			Volumes:        pick(volumeNames),
+		})
+		pod.Annotations[logsidecarInjectedHashAnnotationName] = "hash"
+		pod.Annotations[logsidecarPartsAnnotationName] = string(parts)
+	}
+	return reflect.ValueOf(randomPod{pod})
+}
+
+// isSubsequence tells whether the containers sub are containers of list in the same order.
+func isSubsequence(sub, list []corev1.Container) bool {
+	i := 0
+	for _, c := range list {
+		if i < len(sub) && equality.Semantic.DeepEqual(sub[i], c) {
+			i++
+		}
+	}
+	return i == len(sub)
+}
+
+func TestRemoveLogsidecarPartProperties(t *testing.T) {
+	removes := func(p randomPod) bool {
+		orig := p.Pod.DeepCopy()
+		// slices shared with the pod, which removal must not change
+		sharedInitContainers, sharedContainers, sharedVolumes := p.Spec.InitContainers, p.Spec.Containers, p.Spec.Volumes
+		parts := podInjectedParts(p.Pod)
+		removeLogsidecarPart(p.Pod)
+
+		// the original lists are left as they were
+		if !equality.Semantic.DeepEqual(sharedInitContainers, orig.Spec.InitContainers) ||
+			!equality.Semantic.DeepEqual(sharedContainers, orig.Spec.Containers) ||
+			!equality.Semantic.DeepEqual(sharedVolumes, orig.Spec.Volumes) {
+			t.Logf("original lists changed")
+			return false
+		}
+		if _, ok := p.Annotations[logsidecarPartsAnnotationName]; ok {
+			return false
+		}
+		if parts == nil {
+			orig.Annotations, p.Annotations = nil, nil
+			return equality.Semantic.DeepEqual(orig, p.Pod)
+		}
+
+		// the containers of the injected names are removed, others kept in order
+		kept := func(list, filtered []corev1.Container, names []string) bool {
+			n := 0
+			for _, c := range list {
+				if !containsString(names, c.Name) {
+					n++
+				}
+			}
+			for _, c := range filtered {
+				if containsString(names, c.Name) {
+					return false
+				}
+			}
+			return n == len(filtered) && isSubsequence(filtered, list)
+		}
+		if !kept(orig.Spec.InitContainers, p.Spec.InitContainers, parts.InitContainers) ||
+			!kept(orig.Spec.Containers, p.Spec.Containers, parts.Containers) {
+			t.Logf("containers not removed: %+v", parts)
+			return false
+		}
+
+		// the injected volumes are removed unless still mounted, others kept in order
+		mounted := make(map[string]bool)
+		for _, c := range append(append([]corev1.Container(nil), p.Spec.InitContainers...), p.Spec.Containers...) {
+			for _, vm := range c.VolumeMounts {
+				mounted[vm.Name] = true
+			}
+		}
+		var volumes []corev1.Volume
+		for _, v := range orig.Spec.Volumes {
+			if mounted[v.Name] || !containsString(parts.Volumes, v.Name) {
+				volumes = append(volumes, v)
+			}
+		}
+		if !equality.Semantic.DeepEqual(volumes, p.Spec.Volumes) {
+			t.Logf("volumes not removed: %+v", parts)
+			return false
+		}
+		return true
+	}
+	if err := quick.Check(removes, nil); err != nil {
+		t.Error(err)
+	}
+
+	idempotent := func(p randomPod) bool {
+		annotations := make(map[string]string)
+		for k, v := range p.Annotations {
+			annotations[k] = v
+		}
+		removeLogsidecarPart(p.Pod)
+		once := p.Pod.DeepCopy()
+		p.Annotations = annotations
+		removeLogsidecarPart(p.Pod)
+		return equality.Semantic.DeepEqual(once.Spec, p.Spec)
+	}
+	if err := quick.Check(idempotent, nil); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestLogsidecarPodBaselineInjected(t *testing.T) {
+	// a pod injected by the first releases, which marked nothing
+	baselinePod := func() *corev1.Pod {
+		pod := appPod()
+		pod.Spec.InitContainers = []corev1.Container{{Name: logsidecarInitContainerName, Image: "alpine:3.14",
+			VolumeMounts: []corev1.VolumeMount{{Name: logsidecarVolumeName, MountPath: logsidecarConfigDir}}}}
+		pod.Spec.Containers = append(pod.Spec.Containers, corev1.Container{Name: logsidecarContainerName, Image: "vector:0.10",
+			VolumeMounts: []corev1.VolumeMount{
+				{Name: "datavolume", MountPath: "/container-app-container/data"},
+				{Name: logsidecarVolumeName, MountPath: logsidecarConfigDir},
+			}})
+		pod.Spec.Volumes = append(pod.Spec.Volumes, corev1.Volume{Name: logsidecarVolumeName,
+			VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}}})
+		return pod
+	}
+	labeledPod := func() *corev1.Pod {
+		pod := baselinePod()
+		pod.Spec.InitContainers = nil
+		pod.Labels = map[string]string{logsidecarInjectedLabelName: "true"}
+		return pod
+	}
+	inj := newTestInjector(loadShippedInjectorConfig(t, SidecarTypeVector))
+	for name, pod := range map[string]*corev1.Pod{"baseline": baselinePod(), "labeled": labeledPod()} {
+		t.Run(name, func(t *testing.T) {
+			assert.True(t, hasLogsidecarPart(pod))
+			ar := podAdmissionReview(t, v1beta1.Create, pod, nil)
+			resp := inj.MutateLogsidecarPods(context.Background(), ar)
+			if !assert.True(t, resp.Allowed, resp.Result) {
+				return
+			}
+			injected := applyAdmissionPatch(t, ar, resp)
+			var containers, volumes []string
+			for _, c := range append(injected.Spec.InitContainers, injected.Spec.Containers...) {
+				containers = append(containers, c.Name)
+			}
+			for _, v := range injected.Spec.Volumes {
+				volumes = append(volumes, v.Name)
+			}
+			assert.Equal(t, []string{logsidecarInitContainerName, "app-container", logsidecarContainerName}, containers)
+			assert.Equal(t, []string{"datavolume", logsidecarVolumeName, logsidecarCheckpointVolumeName}, volumes)
+		})
+	}
+}
+
+func TestRemoveLogsidecarPartUserContainers(t *testing.T) {
+	pod := appPod()
+	// a container of the user which happens to have the name of the sidecar
+	pod.Spec.Containers = append(pod.Spec.Containers, corev1.Container{Name: logsidecarContainerName, Image: "user"})
+	assert.False(t, hasLogsidecarPart(pod))
+	before := pod.DeepCopy()
+	removeLogsidecarPart(pod)
+	assert.Equal(t, before, pod)
+}
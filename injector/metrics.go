@@ -0,0 +1,76 @@
+package injector
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const metricsNamespace = "logsidecar_injector"
+
+// Metrics are the metrics of an Injector, registered to a registry of its own.
+type Metrics struct {
+	registry *prometheus.Registry
+
+	driftedPods                *prometheus.GaugeVec
+	driftRestarts              *prometheus.CounterVec
+	configReloads              *prometheus.CounterVec
+	configLastReloadSuccessful prometheus.Gauge
+	configRollbacks            *prometheus.CounterVec
+	configGeneration           prometheus.Gauge
+	configInfo                 *prometheus.GaugeVec
+}
+
+func NewMetrics() *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		driftedPods: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "drifted_pods",
+			Help:      "Number of pods of a workload running a logsidecar injected with a stale config.",
+		}, []string{"namespace", "kind", "name"}),
+		driftRestarts: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "drift_restarts_total",
+			Help:      "Number of rollout restarts of workloads triggered by drifted pods.",
+		}, []string{"namespace", "kind", "name"}),
+		configReloads: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "config_reloads_total",
+			Help:      "Number of config reloads by result, success or failure.",
+		}, []string{"result"}),
+		configLastReloadSuccessful: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "config_last_reload_successful",
+			Help:      "Whether the last config reload succeeded (1) or was rejected (0).",
+		}),
+		configRollbacks: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "config_rollbacks_total",
+			Help:      "Number of config rollbacks by result, success or failure.",
+		}, []string{"result"}),
+		configGeneration: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "config_generation",
+			Help:      "Generation of the active config.",
+		}),
+		configInfo: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "config_info",
+			Help:      "Hash of the active config, always 1.",
+		}, []string{"hash"}),
+	}
+	m.registry.MustRegister(
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+		prometheus.NewGoCollector(),
+		m.driftedPods, m.driftRestarts, m.configReloads, m.configLastReloadSuccessful,
+		m.configRollbacks, m.configGeneration, m.configInfo,
+	)
+	return m
+}
+
+// Handler serves the metrics in the prometheus exposition format.
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
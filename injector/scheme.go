@@ -5,15 +5,13 @@ import (
 	admissionregistrationv1beta1 "k8s.io/api/admissionregistration/v1beta1"
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/runtime"
-	"k8s.io/apimachinery/pkg/runtime/serializer"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 )
 
-var scheme = runtime.NewScheme()
-var codecs = serializer.NewCodecFactory(scheme)
-
-func init() {
+func newScheme() *runtime.Scheme {
+	scheme := runtime.NewScheme()
 	addToScheme(scheme)
+	return scheme
 }
 
 func addToScheme(scheme *runtime.Scheme) {
@@ -0,0 +1,187 @@
+package injector
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	SinkTypeElasticsearch = "elasticsearch"
+	SinkTypeLoki          = "loki"
+	SinkTypeKafka         = "kafka"
+	SinkTypeHTTP          = "http"
+
+	logsidecarSinkAnnotationName = "logging.kubesphere.io/logsidecar-sink"
+	logsidecarSinkVolumeName     = "logsidecar-sink-tls-volume-logging-kubesphere-io"
+	logsidecarSinkTLSDir         = "/etc/logsidecar-sink"
+	sinkCAFileName               = "ca.crt"
+
+	sinkUserEnvName     = "LOGSIDECAR_SINK_USER"
+	sinkPasswordEnvName = "LOGSIDECAR_SINK_PASSWORD"
+	sinkTokenEnvName    = "LOGSIDECAR_SINK_TOKEN"
+)
+
+// SinkConfig configures the sidecar to ship logs directly to a backend instead of
+// writing them to stdout.
+type SinkConfig struct {
+	// Type is one of elasticsearch, loki, kafka and http
+	Type string `json:"type" yaml:"type"`
+	// Endpoints are the urls of elasticsearch, loki or http, or the brokers of kafka
+	Endpoints []string `json:"endpoints" yaml:"endpoints"`
+	// Index is the index of elasticsearch
+	Index string `json:"index,omitempty" yaml:"index,omitempty"`
+	// Topic is the topic of kafka
+	Topic string `json:"topic,omitempty" yaml:"topic,omitempty"`
+	// Labels are the stream labels of loki
+	Labels map[string]string `json:"labels,omitempty" yaml:"labels,omitempty"`
+	Auth   *SinkAuth         `json:"auth,omitempty" yaml:"auth,omitempty"`
+	TLS    *SinkTLS          `json:"tls,omitempty" yaml:"tls,omitempty"`
+}
+
+// SinkAuth holds the credentials of a sink. Credentials from secrets are passed to
+// the sidecar as env vars, so they never appear in the rendered config.
+type SinkAuth struct {
+	User              string                    `json:"user,omitempty" yaml:"user,omitempty"`
+	UserSecretRef     *corev1.SecretKeySelector `json:"userSecretRef,omitempty" yaml:"userSecretRef,omitempty"`
+	PasswordSecretRef *corev1.SecretKeySelector `json:"passwordSecretRef,omitempty" yaml:"passwordSecretRef,omitempty"`
+	// TokenSecretRef refers to a bearer token for loki and http
+	TokenSecretRef *corev1.SecretKeySelector `json:"tokenSecretRef,omitempty" yaml:"tokenSecretRef,omitempty"`
+}
+
+// SinkTLS refers to a CA bundle to verify the sink with, which is mounted into the
+// sidecar as a file.
+type SinkTLS struct {
+	CASecretRef *corev1.SecretKeySelector `json:"caSecretRef,omitempty" yaml:"caSecretRef,omitempty"`
+}
+
+// sinkContext is the sink as the sidecar config templates see it.
+type sinkContext struct {
+	*SinkConfig
+	// User, Password and Token are the credentials of the sink. Those from secrets
+	// are ${ENV} placeholders expanded by the sidecar at runtime.
+	User     string
+	Password string
+	Token    string
+	// CAFile is the path of the CA bundle within the sidecar
+	CAFile string
+}
+
+func validateSecretRef(field string, ref *corev1.SecretKeySelector) error {
+	if ref != nil && (ref.Name == "" || ref.Key == "") {
+		return fmt.Errorf("%s requires name and key", field)
+	}
+	return nil
+}
+
+func validateSink(sidecarType string, sink *SinkConfig) error {
+	if sink == nil {
+		return nil
+	}
+	switch sink.Type {
+	case SinkTypeElasticsearch, SinkTypeKafka:
+	case SinkTypeLoki, SinkTypeHTTP:
+		if sidecarType == SidecarTypeFilebeat {
+			return fmt.Errorf("sink type %s not supported by %s", sink.Type, sidecarType)
+		}
+	default:
+		return fmt.Errorf("sink type %s not supported", sink.Type)
+	}
+	if len(sink.Endpoints) == 0 {
+		return fmt.Errorf("sink %s requires endpoints", sink.Type)
+	}
+	if sink.Type == SinkTypeKafka && sink.Topic == "" {
+		return fmt.Errorf("sink %s requires topic", sink.Type)
+	}
+	if sink.Auth != nil {
+		if err := validateSecretRef("auth.userSecretRef", sink.Auth.UserSecretRef); err != nil {
+			return err
+		}
+		if err := validateSecretRef("auth.passwordSecretRef", sink.Auth.PasswordSecretRef); err != nil {
+			return err
+		}
+		if err := validateSecretRef("auth.tokenSecretRef", sink.Auth.TokenSecretRef); err != nil {
+			return err
+		}
+	}
+	if sink.TLS != nil {
+		if err := validateSecretRef("tls.caSecretRef", sink.TLS.CASecretRef); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// podSink returns the sink of pod, which is the one of the annotation of pod if any,
+// or else the default one of the injector config.
+func podSink(pod *corev1.Pod, iconfig *InjectorConfig) (*SinkConfig, error) {
+	sink := iconfig.SidecarConfig.Sink
+	if sinkStr := strings.TrimSpace(pod.Annotations[logsidecarSinkAnnotationName]); sinkStr != "" {
+		sink = &SinkConfig{}
+		if err := json.Unmarshal([]byte(sinkStr), sink); err != nil {
+			return nil, fmt.Errorf("unable to decode annotations[%s]: %v", logsidecarSinkAnnotationName, err)
+		}
+	}
+	if err := validateSink(iconfig.SidecarType, sink); err != nil {
+		return nil, err
+	}
+	return sink, nil
+}
+
+// podBackend returns the type of the sink of pod, or stdout if it has none.
+func podBackend(pod *corev1.Pod, iconfig *InjectorConfig) string {
+	if sink, err := podSink(pod, iconfig); err == nil && sink != nil {
+		return sink.Type
+	}
+	return "stdout"
+}
+
+func secretEnv(name string, ref *corev1.SecretKeySelector) corev1.EnvVar {
+	return corev1.EnvVar{Name: name, ValueFrom: &corev1.EnvVarSource{SecretKeyRef: ref}}
+}
+
+// sinkPart returns the template context of sink, and the env vars, volume and volume
+// mount the sidecar needs for the credentials and the CA bundle of sink. The volume is
+// named by names.
+func sinkPart(sink *SinkConfig, names NamesConfig) (*sinkContext, []corev1.EnvVar, *corev1.Volume, *corev1.VolumeMount) {
+	if sink == nil {
+		return nil, nil, nil, nil
+	}
+	sc := &sinkContext{SinkConfig: sink}
+	var envs []corev1.EnvVar
+	if auth := sink.Auth; auth != nil {
+		sc.User = auth.User
+		if auth.UserSecretRef != nil {
+			sc.User = "${" + sinkUserEnvName + "}"
+			envs = append(envs, secretEnv(sinkUserEnvName, auth.UserSecretRef))
+		}
+		if auth.PasswordSecretRef != nil {
+			sc.Password = "${" + sinkPasswordEnvName + "}"
+			envs = append(envs, secretEnv(sinkPasswordEnvName, auth.PasswordSecretRef))
+		}
+		if auth.TokenSecretRef != nil {
+			sc.Token = "${" + sinkTokenEnvName + "}"
+			envs = append(envs, secretEnv(sinkTokenEnvName, auth.TokenSecretRef))
+		}
+	}
+	if sink.TLS == nil || sink.TLS.CASecretRef == nil {
+		return sc, envs, nil, nil
+	}
+	sc.CAFile = filepath.Join(logsidecarSinkTLSDir, sinkCAFileName)
+	volume := &corev1.Volume{
+		Name: names.SinkVolume,
+		VolumeSource: corev1.VolumeSource{Secret: &corev1.SecretVolumeSource{
+			SecretName: sink.TLS.CASecretRef.Name,
+			Items:      []corev1.KeyToPath{{Key: sink.TLS.CASecretRef.Key, Path: sinkCAFileName}},
+		}},
+	}
+	volumeMount := &corev1.VolumeMount{
+		Name:      names.SinkVolume,
+		MountPath: logsidecarSinkTLSDir,
+		ReadOnly:  true,
+	}
+	return sc, envs, volume, volumeMount
+}
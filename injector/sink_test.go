@@ -0,0 +1,89 @@
+package injector
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/yaml"
+)
+
+func TestValidateSink(t *testing.T) {
+	tests := []struct {
+		name        string
+		sidecarType string
+		sink        *SinkConfig
+		valid       bool
+	}{
+		{"no sink", SidecarTypeFilebeat, nil, true},
+		{"elasticsearch", SidecarTypeFilebeat, &SinkConfig{Type: SinkTypeElasticsearch, Endpoints: []string{"http://es:9200"}}, true},
+		{"loki by vector", SidecarTypeVector, &SinkConfig{Type: SinkTypeLoki, Endpoints: []string{"http://loki:3100"}}, true},
+		{"loki by filebeat", SidecarTypeFilebeat, &SinkConfig{Type: SinkTypeLoki, Endpoints: []string{"http://loki:3100"}}, false},
+		{"http by filebeat", SidecarTypeFilebeat, &SinkConfig{Type: SinkTypeHTTP, Endpoints: []string{"http://collector"}}, false},
+		{"unknown type", SidecarTypeVector, &SinkConfig{Type: "s3", Endpoints: []string{"http://s3"}}, false},
+		{"no endpoints", SidecarTypeVector, &SinkConfig{Type: SinkTypeHTTP}, false},
+		{"kafka without topic", SidecarTypeVector, &SinkConfig{Type: SinkTypeKafka, Endpoints: []string{"kafka:9092"}}, false},
+		{"secret ref without key", SidecarTypeVector, &SinkConfig{Type: SinkTypeHTTP, Endpoints: []string{"http://collector"},
+			Auth: &SinkAuth{TokenSecretRef: &corev1.SecretKeySelector{LocalObjectReference: corev1.LocalObjectReference{Name: "token"}}}}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateSink(tt.sidecarType, tt.sink)
+			assert.Equal(t, tt.valid, err == nil, err)
+		})
+	}
+}
+
+func TestShippedVectorTemplateSinks(t *testing.T) {
+	iconfig := loadShippedInjectorConfig(t, SidecarTypeVector)
+	tokenRef := &corev1.SecretKeySelector{LocalObjectReference: corev1.LocalObjectReference{Name: "sink"}, Key: "token"}
+	caRef := &corev1.SecretKeySelector{LocalObjectReference: corev1.LocalObjectReference{Name: "sink"}, Key: "ca.crt"}
+	tests := []struct {
+		sink     *SinkConfig
+		expected map[string]interface{}
+	}{{
+		sink: &SinkConfig{Type: SinkTypeLoki, Endpoints: []string{"http://loki:3100"}, Labels: map[string]string{"app": "web"},
+			Auth: &SinkAuth{TokenSecretRef: tokenRef}},
+		expected: map[string]interface{}{
+			"type":     "loki",
+			"inputs":   []interface{}{"logs"},
+			"endpoint": "http://loki:3100",
+			"labels":   map[string]interface{}{"app": "web"},
+			"encoding": map[string]interface{}{"codec": "text"},
+			"auth":     map[string]interface{}{"strategy": "bearer", "token": "${LOGSIDECAR_SINK_TOKEN}"},
+		},
+	}, {
+		sink: &SinkConfig{Type: SinkTypeHTTP, Endpoints: []string{"https://collector/logs"},
+			Auth: &SinkAuth{User: "logsidecar", PasswordSecretRef: tokenRef}, TLS: &SinkTLS{CASecretRef: caRef}},
+		expected: map[string]interface{}{
+			"type":     "http",
+			"inputs":   []interface{}{"logs"},
+			"uri":      "https://collector/logs",
+			"encoding": map[string]interface{}{"codec": "json"},
+			"auth":     map[string]interface{}{"strategy": "basic", "user": "logsidecar", "password": "${LOGSIDECAR_SINK_PASSWORD}"},
+			"tls":      map[string]interface{}{"ca_file": "/etc/logsidecar-sink/ca.crt"},
+		},
+	}}
+	for _, tt := range tests {
+		t.Run(tt.sink.Type, func(t *testing.T) {
+			sc, _, _, _ := sinkPart(tt.sink, NamesConfig{}.withDefaults())
+			var buffer bytes.Buffer
+			if err := iconfig.VectorConfigTemplate.Execute(&buffer, templateContext{Paths: []string{"/data/*.log"}, Sink: sc}); err != nil {
+				t.Fatal(err)
+			}
+			configJson, err := yaml.YAMLToJSONStrict(buffer.Bytes())
+			if err != nil {
+				t.Fatalf("invalid config %s: %v", buffer.String(), err)
+			}
+			var config struct {
+				Sinks map[string]map[string]interface{} `json:"sinks"`
+			}
+			if err = json.Unmarshal(configJson, &config); err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, map[string]map[string]interface{}{tt.sink.Type: tt.expected}, config.Sinks)
+		})
+	}
+}
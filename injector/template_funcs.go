@@ -0,0 +1,103 @@
+package injector
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"text/template"
+
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/yaml"
+)
+
+// templateFuncs returns the functions available to the sidecar config templates:
+//
+//	quote VALUE             VALUE as a double-quoted string, safe to embed in yaml
+//	toYaml VALUE            VALUE marshaled to yaml, without the trailing newline
+//	default DEFAULT VALUE   VALUE, or DEFAULT if VALUE is empty
+//	label KEY               the label KEY of the pod, or "" if absent
+//	annotation KEY          the annotation KEY of the pod, or "" if absent
+//	join SEP LIST           the elements of LIST joined by SEP
+//	hasPrefix PREFIX STRING whether STRING begins with PREFIX
+//	indent N STRING         STRING with every line indented by N spaces
+//
+// label and annotation are bound to a pod by podTemplate.
+func templateFuncs() template.FuncMap {
+	return template.FuncMap{
+		"quote":      quote,
+		"toYaml":     toYaml,
+		"default":    defaultValue,
+		"label":      func(string) string { return "" },
+		"annotation": func(string) string { return "" },
+		"join":       join,
+		"hasPrefix":  func(prefix, s string) bool { return strings.HasPrefix(s, prefix) },
+		"indent":     indent,
+	}
+}
+
+// podTemplate returns a copy of tmpl with label and annotation bound to pod.
+func podTemplate(tmpl *template.Template, pod *corev1.Pod) (*template.Template, error) {
+	podTmpl, err := tmpl.Clone()
+	if err != nil {
+		return nil, err
+	}
+	return podTmpl.Funcs(template.FuncMap{
+		"label":      func(key string) string { return pod.Labels[key] },
+		"annotation": func(key string) string { return pod.Annotations[key] },
+	}), nil
+}
+
+func quote(v interface{}) string {
+	return strconv.Quote(fmt.Sprint(v))
+}
+
+func toYaml(v interface{}) (string, error) {
+	out, err := yaml.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(string(out), "\n"), nil
+}
+
+func defaultValue(def interface{}, v ...interface{}) interface{} {
+	if len(v) == 0 || v[0] == nil {
+		return def
+	}
+	rv := reflect.ValueOf(v[0])
+	switch rv.Kind() {
+	case reflect.Array, reflect.Slice, reflect.Map, reflect.String:
+		if rv.Len() == 0 {
+			return def
+		}
+	case reflect.Ptr, reflect.Interface:
+		if rv.IsNil() {
+			return def
+		}
+	default:
+		if rv.IsZero() {
+			return def
+		}
+	}
+	return v[0]
+}
+
+func join(sep string, list interface{}) (string, error) {
+	if list == nil {
+		return "", nil
+	}
+	rv := reflect.ValueOf(list)
+	if rv.Kind() != reflect.Array && rv.Kind() != reflect.Slice {
+		return "", fmt.Errorf("join of %T not supported", list)
+	}
+	elems := make([]string, rv.Len())
+	for i := range elems {
+		elems[i] = fmt.Sprint(rv.Index(i).Interface())
+	}
+	return strings.Join(elems, sep), nil
+}
+
+func indent(n int, s string) string {
+	pad := strings.Repeat(" ", n)
+	return pad + strings.Replace(s, "\n", "\n"+pad, -1)
+}
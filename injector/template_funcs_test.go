@@ -0,0 +1,87 @@
+package injector
+
+import (
+	"bytes"
+	"testing"
+	"text/template"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/yaml"
+)
+
+func TestTemplateFuncs(t *testing.T) {
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Labels:      map[string]string{"app": "web"},
+			Annotations: map[string]string{"team": "logging"},
+		},
+	}
+	tests := []struct {
+		name     string
+		text     string
+		data     interface{}
+		expected string
+	}{
+		{"quote", `{{quote .}}`, `a "b" \c`, `"a \"b\" \\c"`},
+		{"quote number", `{{quote .}}`, 1, `"1"`},
+		{"toYaml", `{{toYaml .}}`, map[string]interface{}{"b": []int{1}, "a": "x"}, "a: x\nb:\n- 1"},
+		{"default empty", `{{default "none" .}}`, "", "none"},
+		{"default nil", `{{default "none" .}}`, nil, "none"},
+		{"default value", `{{default "none" .}}`, "some", "some"},
+		{"default empty list", `{{default "none" .}}`, []string{}, "none"},
+		{"label", `{{label "app"}}`, nil, "web"},
+		{"absent label with default", `{{label "tier" | default "backend"}}`, nil, "backend"},
+		{"annotation", `{{annotation "team"}}`, nil, "logging"},
+		{"join", `{{join "," .}}`, []string{"a", "b"}, "a,b"},
+		{"join interfaces", `{{join ", " .}}`, []interface{}{"a", 1}, "a, 1"},
+		{"hasPrefix", `{{if hasPrefix "/var" .}}yes{{end}}`, "/var/log", "yes"},
+		{"not hasPrefix", `{{if hasPrefix "/var" .}}yes{{end}}`, "/data", ""},
+		{"indent", `{{indent 2 .}}`, "a:\n  b: c", "  a:\n    b: c"},
+		{"indent toYaml", `x:{{"\n"}}{{toYaml . | indent 2}}`, map[string]string{"a": "b"}, "x:\n  a: b"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpl, err := template.New(tt.name).Funcs(templateFuncs()).Parse(tt.text)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tmpl, err = podTemplate(tmpl, pod); err != nil {
+				t.Fatal(err)
+			}
+			var buffer bytes.Buffer
+			if err = tmpl.Execute(&buffer, tt.data); err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, tt.expected, buffer.String())
+		})
+	}
+}
+
+func TestShippedTemplatesWithTemplateFuncs(t *testing.T) {
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{"app": "web"}}}
+	sc, _, _, _ := sinkPart(&SinkConfig{Type: SinkTypeKafka, Endpoints: []string{"kafka-0:9092", "kafka-1:9092"}, Topic: "logs"}, NamesConfig{}.withDefaults())
+	for _, sidecarType := range []string{SidecarTypeVector, SidecarTypeFilebeat} {
+		for _, sink := range []*sinkContext{nil, sc} {
+			iconfig := loadShippedInjectorConfig(t, sidecarType)
+			tmpl := iconfig.VectorConfigTemplate
+			if sidecarType == SidecarTypeFilebeat {
+				tmpl = iconfig.FilebeatConfigTemplate
+			}
+			tmpl, err := podTemplate(tmpl, pod)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var buffer bytes.Buffer
+			// paths with characters special to yaml are quoted
+			if err = tmpl.Execute(&buffer, templateContext{Paths: []string{"/data/#1/*.log", "/data/a: b.log"}, Sink: sink}); err != nil {
+				t.Fatal(err)
+			}
+			if _, err = yaml.YAMLToJSONStrict(buffer.Bytes()); err != nil {
+				t.Fatalf("%s: invalid config %s: %v", sidecarType, buffer.String(), err)
+			}
+			assert.Contains(t, buffer.String(), `"/data/a: b.log"`)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package injector
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+var tlsVersions = map[string]uint16{
+	"VersionTLS10": tls.VersionTLS10,
+	"VersionTLS11": tls.VersionTLS11,
+	"VersionTLS12": tls.VersionTLS12,
+	"VersionTLS13": tls.VersionTLS13,
+}
+
+var tlsCurves = map[string]tls.CurveID{
+	"X25519":    tls.X25519,
+	"CurveP256": tls.CurveP256,
+	"CurveP384": tls.CurveP384,
+	"CurveP521": tls.CurveP521,
+}
+
+// http2RequiredCipherSuites are the cipher suites of which HTTP/2 over TLS 1.2
+// requires one to be enabled, see RFC 7540 section 9.2.2.
+var http2RequiredCipherSuites = []uint16{
+	tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+}
+
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func cipherSuites(names []string) ([]uint16, error) {
+	secure := make(map[string]uint16)
+	for _, cs := range tls.CipherSuites() {
+		secure[cs.Name] = cs.ID
+	}
+	insecure := make(map[string]bool)
+	for _, cs := range tls.InsecureCipherSuites() {
+		insecure[cs.Name] = true
+	}
+	var ids []uint16
+	for _, name := range names {
+		id, ok := secure[name]
+		if !ok {
+			if insecure[name] {
+				return nil, fmt.Errorf("insecure cipher suite %s not allowed", name)
+			}
+			return nil, fmt.Errorf("unknown cipher suite %s", name)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// serverTLSConfig returns the tls config of the servers by the tls flags of c, and
+// rejects the insecure ones.
+func (c *Config) serverTLSConfig() (*tls.Config, error) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if c.TLSMinVersion != "" {
+		version, ok := tlsVersions[c.TLSMinVersion]
+		if !ok {
+			return nil, fmt.Errorf("unknown tls version %s", c.TLSMinVersion)
+		}
+		if version < tls.VersionTLS12 {
+			return nil, fmt.Errorf("insecure tls version %s not allowed, use VersionTLS12 or above", c.TLSMinVersion)
+		}
+		tlsConfig.MinVersion = version
+	}
+
+	if names := splitList(c.TLSCipherSuites); len(names) > 0 {
+		if tlsConfig.MinVersion >= tls.VersionTLS13 {
+			return nil, fmt.Errorf("cipher suites of %s are not configurable", c.TLSMinVersion)
+		}
+		ids, err := cipherSuites(names)
+		if err != nil {
+			return nil, err
+		}
+		if c.HTTP2 && !containsCipherSuite(ids, http2RequiredCipherSuites) {
+			return nil, fmt.Errorf("http2 requires cipher suite %s or %s",
+				tls.CipherSuiteName(http2RequiredCipherSuites[0]), tls.CipherSuiteName(http2RequiredCipherSuites[1]))
+		}
+		tlsConfig.CipherSuites = ids
+	}
+
+	for _, name := range splitList(c.TLSCurvePreferences) {
+		curve, ok := tlsCurves[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown curve %s", name)
+		}
+		tlsConfig.CurvePreferences = append(tlsConfig.CurvePreferences, curve)
+	}
+
+	tlsConfig.NextProtos = []string{"http/1.1"}
+	if c.HTTP2 {
+		tlsConfig.NextProtos = []string{"h2", "http/1.1"}
+	}
+	return tlsConfig, nil
+}
+
+func containsCipherSuite(ids, any []uint16) bool {
+	for _, id := range ids {
+		for _, a := range any {
+			if id == a {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ConfigureServer sets the timeouts of server, and disables HTTP/2 of server unless
+// enabled by the flags of c.
+func (c *Config) ConfigureServer(server *http.Server) {
+	server.ReadHeaderTimeout = c.ReadTimeout
+	server.ReadTimeout = c.ReadTimeout
+	server.WriteTimeout = c.WriteTimeout
+	server.IdleTimeout = c.IdleTimeout
+	if !c.HTTP2 {
+		// a non-nil map keeps net/http from configuring HTTP/2
+		server.TLSNextProto = make(map[string]func(*http.Server, *tls.Conn, http.Handler))
+	}
+}
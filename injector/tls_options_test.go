@@ -0,0 +1,75 @@
+package injector
+
+import (
+	"crypto/tls"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServerTLSConfig(t *testing.T) {
+	tests := []struct {
+		name     string
+		config   Config
+		valid    bool
+		expected *tls.Config
+	}{{
+		name:     "defaults",
+		config:   Config{HTTP2: true},
+		valid:    true,
+		expected: &tls.Config{MinVersion: tls.VersionTLS12, NextProtos: []string{"h2", "http/1.1"}},
+	}, {
+		name: "all options",
+		config: Config{
+			TLSMinVersion:       "VersionTLS12",
+			TLSCipherSuites:     "TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384, TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256",
+			TLSCurvePreferences: "X25519,CurveP256",
+			HTTP2:               true,
+		},
+		valid: true,
+		expected: &tls.Config{
+			MinVersion:       tls.VersionTLS12,
+			CipherSuites:     []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384, tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256},
+			CurvePreferences: []tls.CurveID{tls.X25519, tls.CurveP256},
+			NextProtos:       []string{"h2", "http/1.1"},
+		},
+	}, {
+		name:     "tls 1.3 without http2",
+		config:   Config{TLSMinVersion: "VersionTLS13"},
+		valid:    true,
+		expected: &tls.Config{MinVersion: tls.VersionTLS13, NextProtos: []string{"http/1.1"}},
+	}, {
+		name:   "insecure tls version",
+		config: Config{TLSMinVersion: "VersionTLS10"},
+	}, {
+		name:   "unknown tls version",
+		config: Config{TLSMinVersion: "TLS12"},
+	}, {
+		name:   "insecure cipher suite",
+		config: Config{TLSCipherSuites: "TLS_RSA_WITH_RC4_128_SHA"},
+	}, {
+		name:   "unknown cipher suite",
+		config: Config{TLSCipherSuites: "TLS_UNKNOWN"},
+	}, {
+		name:   "cipher suites of tls 1.3",
+		config: Config{TLSMinVersion: "VersionTLS13", TLSCipherSuites: "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"},
+	}, {
+		name:   "http2 without required cipher suite",
+		config: Config{TLSCipherSuites: "TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384", HTTP2: true},
+	}, {
+		name:   "unknown curve",
+		config: Config{TLSCurvePreferences: "P256"},
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tlsConfig, err := tt.config.serverTLSConfig()
+			if !tt.valid {
+				assert.Error(t, err)
+				return
+			}
+			if assert.NoError(t, err) {
+				assert.Equal(t, tt.expected, tlsConfig)
+			}
+		})
+	}
+}
@@ -0,0 +1,71 @@
+package injector
+
+import (
+	"context"
+	"fmt"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.7.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	tracerName         = "github.com/kubesphere/logsidecar-injector/injector"
+	tracingServiceName = "logsidecar-injector"
+)
+
+// tracePropagator extracts the trace context the apiserver passes to webhooks.
+var tracePropagator = propagation.TraceContext{}
+
+// NewTracerProvider returns the tracer provider of the tracing flags of c, which
+// exports spans to an OTLP/HTTP collector, or nil if tracing is disabled.
+func NewTracerProvider(c *Config) (*sdktrace.TracerProvider, error) {
+	if c.TracingEndpoint == "" {
+		return nil, nil
+	}
+	if c.TracingSampleRatio < 0 || c.TracingSampleRatio > 1 {
+		return nil, fmt.Errorf("tracing sample ratio %v not within [0, 1]", c.TracingSampleRatio)
+	}
+	opts := []otlptracehttp.Option{otlptracehttp.WithEndpoint(c.TracingEndpoint)}
+	if c.TracingInsecure {
+		opts = append(opts, otlptracehttp.WithInsecure())
+	}
+	exporter, err := otlptracehttp.New(context.Background(), opts...)
+	if err != nil {
+		return nil, err
+	}
+	return newTracerProvider(sdktrace.NewBatchSpanProcessor(exporter), c.TracingSampleRatio), nil
+}
+
+// newTracerProvider returns a tracer provider passing the spans to processor. Traces
+// started by the apiserver are sampled as it decided, others by ratio.
+func newTracerProvider(processor sdktrace.SpanProcessor, ratio float64) *sdktrace.TracerProvider {
+	return sdktrace.NewTracerProvider(
+		sdktrace.WithSpanProcessor(processor),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(ratio))),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL,
+			semconv.ServiceNameKey.String(tracingServiceName))),
+	)
+}
+
+// startSpan starts a span named name as child of the span of ctx. It takes the tracer
+// from the tracer provider of the parent span, so that nothing is recorded unless the
+// admission is traced.
+func startSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return trace.SpanFromContext(ctx).TracerProvider().Tracer(tracerName).
+		Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// endSpan ends span, marking it as failed with err if not nil.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
@@ -0,0 +1,83 @@
+package injector
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"k8s.io/api/admission/v1beta1"
+)
+
+func tracedAdmission(t *testing.T, traceparent string) tracetest.SpanStubs {
+	inj := newTestInjector(loadShippedInjectorConfig(t, SidecarTypeVector))
+	exporter := tracetest.NewInMemoryExporter()
+	inj.TracerProvider = newTracerProvider(sdktrace.NewSimpleSpanProcessor(exporter), 1)
+
+	pod := appPod()
+	pod.Annotations[logsidecarVectorPatchAnnotationName] = `[{"op": "add", "path": "/sources/patched", "value": {}}]`
+	ar := podAdmissionReview(t, v1beta1.Create, pod, nil)
+	ar.APIVersion, ar.Kind = "admission.k8s.io/v1beta1", "AdmissionReview"
+	body, err := json.Marshal(ar)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	if traceparent != "" {
+		r.Header.Set("traceparent", traceparent)
+	}
+	w := httptest.NewRecorder()
+	inj.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+	return exporter.GetSpans()
+}
+
+func TestTracing(t *testing.T) {
+	spans := tracedAdmission(t, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+
+	byName := make(map[string]tracetest.SpanStub)
+	for _, span := range spans {
+		byName[span.Name] = span
+	}
+	parents := map[string]string{
+		"admission":               "",
+		"decode admission review": "admission",
+		"mutate pod":              "admission",
+		"decode pod":              "mutate pod",
+		"resolve config":          "mutate pod",
+		"render template":         "mutate pod",
+		"patch config":            "mutate pod",
+		"create patch":            "mutate pod",
+	}
+	assert.Len(t, spans, len(parents))
+	traceID, _ := trace.TraceIDFromHex("4bf92f3577b34da6a3ce929d0e0e4736")
+	for name, parent := range parents {
+		span, ok := byName[name]
+		if !assert.True(t, ok, "no span %s", name) {
+			continue
+		}
+		assert.Equal(t, traceID, span.SpanContext.TraceID(), name)
+		if parent == "" {
+			assert.Equal(t, trace.SpanKindServer, span.SpanKind)
+			assert.True(t, span.Parent.IsRemote())
+			continue
+		}
+		assert.Equal(t, byName[parent].SpanContext.SpanID(), span.Parent.SpanID(), name)
+	}
+	for _, attr := range byName["mutate pod"].Attributes {
+		if attr.Key == "admission.decision" {
+			assert.Equal(t, AuditDecisionInjected, attr.Value.AsString())
+		}
+	}
+}
+
+func TestTracingNotSampled(t *testing.T) {
+	assert.Empty(t, tracedAdmission(t, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00"))
+	assert.NotEmpty(t, tracedAdmission(t, ""))
+}
@@ -22,6 +22,13 @@ func JoinLines(lines string, addLinePrefix, addLineSuffix string) string {
 	return sb.String()
 }
 
+// escapeDoubleQuoted escapes s to be put literally within double quotes of a shell command.
+func escapeDoubleQuoted(s string) string {
+	return doubleQuotedEscaper.Replace(s)
+}
+
+var doubleQuotedEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "$", `\$`, "`", "\\`")
+
 func PatchYaml(yamlString, patchJsonString string) (string, error) {
 	patch, err := jsonpatch.DecodePatch([]byte(patchJsonString))
 	if err != nil {
@@ -2,14 +2,20 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"github.com/julienschmidt/httprouter"
 	"github.com/kubesphere/logsidecar-injector/injector"
 	"golang.org/x/sync/errgroup"
+	"k8s.io/client-go/kubernetes"
 	_ "k8s.io/client-go/plugin/pkg/client/auth/gcp"
+	"k8s.io/client-go/tools/clientcmd"
 	"k8s.io/klog"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
 )
 
 func main() {
@@ -17,15 +23,26 @@ func main() {
 	config.AddFlags()
 	klog.InitFlags(nil)
 	flag.Parse()
-	if err := injector.ReloadInjectorConfig(&config); err != nil {
+	inj := injector.NewInjector(&config)
+	auditLog, err := injector.NewAuditLog(&config)
+	if err != nil {
+		klog.Fatal(err)
+	}
+	inj.Audit = auditLog
+	tracerProvider, err := injector.NewTracerProvider(&config)
+	if err != nil {
+		klog.Fatal(err)
+	}
+	if tracerProvider != nil {
+		inj.TracerProvider = tracerProvider
+	}
+	if err := inj.Configs.Reload(); err != nil {
 		klog.Fatal(err)
 	}
-	ctx, cancel := context.WithCancel(context.Background())
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 
 	tlsRouter := httprouter.New()
-	tlsRouter.POST("/", func(writer http.ResponseWriter, request *http.Request, params httprouter.Params) {
-		injector.ServeLogSidecarPods(writer, request)
-	})
+	tlsRouter.Handler(http.MethodPost, "/", inj)
 
 	webReload := make(chan chan error)
 	tlsConfig, err := config.TLSConfig(ctx.Done(), webReload)
@@ -33,19 +50,36 @@ func main() {
 		klog.Fatal(err)
 	}
 	tlsServer := &http.Server{
-		Addr:      ":8443",
+		Addr:      config.ListenAddress,
 		Handler:   tlsRouter,
 		TLSConfig: tlsConfig,
 	}
+	config.ConfigureServer(tlsServer)
+
+	var client kubernetes.Interface
+	if config.DriftDetection || config.AdminKubernetesAuth {
+		restConfig, err := clientcmd.BuildConfigFromFlags("", config.Kubeconfig)
+		if err != nil {
+			klog.Fatal(err)
+		}
+		if client, err = kubernetes.NewForConfig(restConfig); err != nil {
+			klog.Fatal(err)
+		}
+	}
+
+	adminAuth, err := injector.NewAdminAuth(&config, client)
+	if err != nil {
+		klog.Fatal(err)
+	}
 
 	router := httprouter.New()
 	router.POST("/-/reload", func(writer http.ResponseWriter, request *http.Request, params httprouter.Params) {
-		if err := injector.ReloadInjectorConfig(&config); err != nil {
+		if err := inj.Configs.Reload(); err != nil {
 			m := fmt.Sprintf("failed to reload config: %s", err)
 			http.Error(writer, m, http.StatusInternalServerError)
 			klog.Error(m)
 		} else {
-			klog.Info("config reloaded")
+			klog.Infof("config reloaded as generation %d", inj.Configs.Get().Generation)
 		}
 
 		errc := make(chan error)
@@ -59,23 +93,88 @@ func main() {
 			klog.Info("certs reloaded")
 		}
 	})
+	router.GET("/-/config", func(writer http.ResponseWriter, request *http.Request, params httprouter.Params) {
+		writer.Header().Set("Content-Type", "application/json")
+		// the contents of the config may hold credentials
+		if err := json.NewEncoder(writer).Encode(inj.Configs.Status(adminAuth.Enabled())); err != nil {
+			klog.Error(err)
+		}
+	})
+	router.POST("/-/rollback", func(writer http.ResponseWriter, request *http.Request, params httprouter.Params) {
+		ic, err := inj.Configs.Rollback()
+		if err != nil {
+			m := fmt.Sprintf("failed to rollback config: %s", err)
+			http.Error(writer, m, http.StatusConflict)
+			klog.Error(m)
+			return
+		}
+		klog.Infof("config rolled back to generation %d", ic.Generation)
+		fmt.Fprintf(writer, "config rolled back to generation %d\n", ic.Generation)
+	})
+	router.Handler(http.MethodGet, "/metrics", inj.Metrics.Handler())
+
+	adminTLSConfig, err := config.AdminTLSConfig()
+	if err != nil {
+		klog.Fatal(err)
+	}
 	server := &http.Server{
-		Addr:    ":9443",
-		Handler: router,
+		Addr:      config.AdminAddress,
+		Handler:   adminAuth.Wrap(router),
+		TLSConfig: adminTLSConfig,
+	}
+	config.ConfigureServer(server)
+
+	if config.DriftDetection {
+		driftController := injector.NewDriftController(inj, client, config.DriftRolloutRestart)
+		go func() {
+			err := config.RunLeaderElected(ctx, client, func(ctx context.Context) {
+				driftController.Run(config.DriftDetectionInterval, ctx.Done())
+			})
+			if err != nil {
+				klog.Fatal(err)
+			}
+		}()
 	}
 
 	wg, ctx := errgroup.WithContext(ctx)
 	wg.Go(func() error {
-		return tlsServer.ListenAndServeTLS("", "")
+		if err := tlsServer.ListenAndServeTLS("", ""); err != http.ErrServerClosed {
+			return err
+		}
+		return nil
 	})
 	wg.Go(func() error {
-		return server.ListenAndServe()
+		var err error
+		if server.TLSConfig != nil {
+			err = server.ListenAndServeTLS("", "")
+		} else {
+			err = server.ListenAndServe()
+		}
+		if err != http.ErrServerClosed {
+			return err
+		}
+		return nil
 	})
 
-	select {
-	case <-ctx.Done():
-	}
+	// until a signal is received or a server fails
+	<-ctx.Done()
 	cancel()
+	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), config.WriteTimeout)
+	defer shutdownCancel()
+	for _, s := range []*http.Server{tlsServer, server} {
+		if err := s.Shutdown(shutdownCtx); err != nil {
+			klog.Error(err)
+		}
+	}
+	if tracerProvider != nil {
+		if err := tracerProvider.Shutdown(context.Background()); err != nil {
+			klog.Error(err)
+		}
+	}
+	// no admissions are audited after the servers are shut down
+	if err := auditLog.Close(); err != nil {
+		klog.Error(err)
+	}
 	if err := wg.Wait(); err != nil {
 		klog.Fatalf("Unhandled error received: %v. Exiting...\n", err)
 	}